@@ -4,21 +4,26 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
 
+	"github.com/missuo/traffic-monitor/proxy"
 	"github.com/missuo/traffic-monitor/stats"
 )
 
 type Server struct {
-	port    int
-	token   string
-	manager *stats.StatsManager
-	server  *http.Server
+	port     int
+	token    string
+	manager  *stats.StatsManager
+	registry *proxy.Registry
+	server   *http.Server
 }
 
 type StatsResponse struct {
@@ -26,20 +31,46 @@ type StatsResponse struct {
 }
 
 type ProxyStatsResponse struct {
-	Name                 string      `json:"name"`
-	Protocol             string      `json:"protocol"`
-	ListenPort           int         `json:"listen_port"`
-	TargetPort           int         `json:"target_port"`
-	Total                TrafficData `json:"total"`
-	Monthly              MonthlyData `json:"monthly"`
-	Limit                int64       `json:"limit"`
-	LimitHuman           string      `json:"limit_human"`
-	LimitExceeded        bool        `json:"limit_exceeded"`
-	Usage                *UsageData  `json:"usage,omitempty"`
-	LimitMonthly         int64       `json:"limit_monthly"`
-	LimitMonthlyHuman    string      `json:"limit_monthly_human"`
-	LimitMonthlyExceeded bool        `json:"limit_monthly_exceeded"`
-	UsageMonthly         *UsageData  `json:"usage_monthly,omitempty"`
+	Name                 string             `json:"name"`
+	Protocol             string             `json:"protocol"`
+	ListenPort           int                `json:"listen_port"`
+	TargetPort           int                `json:"target_port"`
+	Total                TrafficData        `json:"total"`
+	Monthly              MonthlyData        `json:"monthly"`
+	Limit                int64              `json:"limit"`
+	LimitHuman           string             `json:"limit_human"`
+	LimitExceeded        bool               `json:"limit_exceeded"`
+	Usage                *UsageData         `json:"usage,omitempty"`
+	LimitMonthly         int64              `json:"limit_monthly"`
+	LimitMonthlyHuman    string             `json:"limit_monthly_human"`
+	LimitMonthlyExceeded bool               `json:"limit_monthly_exceeded"`
+	UsageMonthly         *UsageData         `json:"usage_monthly,omitempty"`
+	OnExceed             string             `json:"on_exceed"`
+	ActivePolicy         string             `json:"active_policy"`
+	ActiveConnections    int64              `json:"active_connections"`
+	ActiveUDPSessions    int64              `json:"active_udp_sessions"`
+	Rejected             stats.Rejections   `json:"rejected"`
+	Errors               stats.Errors       `json:"errors"`
+	UDPSessions          *stats.UDPSessions `json:"udp_sessions,omitempty"`
+	TLSOverhead          *TrafficData       `json:"tls_overhead,omitempty"`
+	Targets              []TargetData       `json:"targets,omitempty"`
+	Protocols            []ProtocolData     `json:"protocols,omitempty"`
+	AddressFamilies      []FamilyData       `json:"address_families,omitempty"`
+	Health               []TargetHealth     `json:"health,omitempty"`
+}
+
+type HealthResponse struct {
+	Status  string                    `json:"status"`
+	Proxies map[string][]TargetHealth `json:"proxies,omitempty"`
+}
+
+type TargetHealth struct {
+	Address   string     `json:"address"`
+	Healthy   bool       `json:"healthy"`
+	Backup    bool       `json:"backup,omitempty"`
+	Active    int64      `json:"active"`
+	LastCheck *time.Time `json:"last_check,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
 }
 
 type UsageData struct {
@@ -57,6 +88,21 @@ type TrafficData struct {
 	DownloadHuman string `json:"download_human"`
 }
 
+type TargetData struct {
+	Address string `json:"address"`
+	TrafficData
+}
+
+type ProtocolData struct {
+	Protocol string `json:"protocol"`
+	TrafficData
+}
+
+type FamilyData struct {
+	Family string `json:"family"`
+	TrafficData
+}
+
 type MonthlyData struct {
 	Month         string `json:"month"`
 	Upload        int64  `json:"upload"`
@@ -65,11 +111,74 @@ type MonthlyData struct {
 	DownloadHuman string `json:"download_human"`
 }
 
-func NewServer(port int, token string, manager *stats.StatsManager) *Server {
+type ClientsResponse struct {
+	Name         string       `json:"name"`
+	Total        int          `json:"total"`   // clients tracked
+	Evicted      int64        `json:"evicted"` // entries evicted to stay within max_clients
+	Limit        int64        `json:"limit,omitempty"`
+	LimitMonthly int64        `json:"limit_monthly,omitempty"`
+	OnExceed     string       `json:"on_exceed,omitempty"`
+	Clients      []ClientData `json:"clients"`
+}
+
+type ClientData struct {
+	Client string `json:"client"`
+	TrafficData
+	Monthly       MonthlyData `json:"monthly"`
+	Usage         *UsageData  `json:"usage,omitempty"`
+	UsageMonthly  *UsageData  `json:"usage_monthly,omitempty"`
+	LimitExceeded bool        `json:"limit_exceeded,omitempty"`
+	LastSeen      time.Time   `json:"last_seen"`
+}
+
+type ConnectionsResponse struct {
+	Name        string               `json:"name"`
+	Connections []ConnectionResponse `json:"connections"`
+}
+
+type ConnectionResponse struct {
+	ID            string    `json:"id"`
+	Protocol      string    `json:"protocol"`
+	ClientAddr    string    `json:"client_addr"`
+	TargetAddr    string    `json:"target_addr"`
+	StartTime     time.Time `json:"start_time"`
+	LastActive    time.Time `json:"last_active"`
+	Upload        int64     `json:"upload"`
+	Download      int64     `json:"download"`
+	UploadHuman   string    `json:"upload_human"`
+	DownloadHuman string    `json:"download_human"`
+
+	UploadPackets   int64 `json:"upload_packets,omitempty"` // UDP sessions only
+	DownloadPackets int64 `json:"download_packets,omitempty"`
+}
+
+// ACLData is an access control list in CIDR notation. Deny rules win; with
+// allow rules, only matching clients are served.
+type ACLData struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+type BansResponse struct {
+	Bans []proxy.Ban `json:"bans"`
+}
+
+type BanRequest struct {
+	IP       string `json:"ip" binding:"required"`
+	Duration string `json:"duration"` // e.g., "1h", empty = the configured ban duration
+	Reason   string `json:"reason"`
+}
+
+type AccessLogResponse struct {
+	Entries []proxy.AccessLogEntry `json:"entries"`
+}
+
+func NewServer(port int, token string, manager *stats.StatsManager, registry *proxy.Registry) *Server {
 	return &Server{
-		port:    port,
-		token:   token,
-		manager: manager,
+		port:     port,
+		token:    token,
+		manager:  manager,
+		registry: registry,
 	}
 }
 
@@ -88,6 +197,23 @@ func (s *Server) Start() error {
 	{
 		api.GET("/stats", s.handleStats)
 		api.GET("/stats/:name", s.handleStatsByName)
+		api.GET("/stats/:name/clients", s.handleClients)
+		api.GET("/proxies/:name/connections", s.handleConnections)
+		api.GET("/acl", s.handleGetACL)
+		api.GET("/proxies/:name/acl", s.handleGetACL)
+		api.GET("/bans", s.handleBans)
+		api.GET("/access-log", s.handleAccessLog)
+	}
+
+	// Endpoints that change state are only served with authentication
+	if s.token != "" {
+		api.DELETE("/proxies/:name/connections/:id", s.handleKillConnection)
+		api.PUT("/acl", s.handleSetACL)
+		api.PUT("/proxies/:name/acl", s.handleSetACL)
+		api.POST("/bans", s.handleBan)
+		api.DELETE("/bans/:ip", s.handleUnban)
+	} else {
+		log.Printf("[API] No token set, endpoints that kill connections or change ACLs and bans are disabled")
 	}
 
 	s.server = &http.Server{
@@ -136,7 +262,52 @@ func (s *Server) authMiddleware() gin.HandlerFunc {
 }
 
 func (s *Server) handleHealth(c *gin.Context) {
-	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	response := HealthResponse{Status: "ok"}
+
+	for name, balancers := range s.registry.Balancers() {
+		for _, b := range balancers {
+			if !b.HealthChecked() {
+				continue
+			}
+			if response.Proxies == nil {
+				response.Proxies = make(map[string][]TargetHealth)
+			}
+
+			health := targetHealth(b)
+			available := false
+			for _, t := range health {
+				if t.Healthy && !t.Backup {
+					available = true
+				}
+			}
+			if !available {
+				response.Status = "degraded"
+			}
+			response.Proxies[name] = append(response.Proxies[name], health...)
+		}
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+func targetHealth(b *proxy.Balancer) []TargetHealth {
+	targets := b.Targets()
+	result := make([]TargetHealth, 0, len(targets))
+	for _, t := range targets {
+		healthy, lastCheck, lastError := t.Health()
+		th := TargetHealth{
+			Address:   t.Addr,
+			Healthy:   healthy,
+			Backup:    t.IsBackup(),
+			Active:    t.Active(),
+			LastError: lastError,
+		}
+		if !lastCheck.IsZero() {
+			th.LastCheck = &lastCheck
+		}
+		result = append(result, th)
+	}
+	return result
 }
 
 func (s *Server) handleStats(c *gin.Context) {
@@ -168,6 +339,281 @@ func (s *Server) handleStatsByName(c *gin.Context) {
 	c.JSON(http.StatusOK, s.convertToResponse(stat))
 }
 
+// clientSortKeys are the orders accepted by the sort parameter of
+// handleClients, largest first.
+var clientSortKeys = map[string]func(t stats.ClientTraffic) int64{
+	"total":    func(t stats.ClientTraffic) int64 { return t.Upload + t.Download },
+	"monthly":  func(t stats.ClientTraffic) int64 { return t.MonthlyUpload + t.MonthlyDownload },
+	"upload":   func(t stats.ClientTraffic) int64 { return t.Upload },
+	"download": func(t stats.ClientTraffic) int64 { return t.Download },
+}
+
+func (s *Server) handleClients(c *gin.Context) {
+	name := c.Param("name")
+	stat := s.manager.Get(name)
+	if stat == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "proxy not found"})
+		return
+	}
+
+	top, err := strconv.Atoi(c.DefaultQuery("top", "100"))
+	if err != nil || top < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "top must be a non-negative number"})
+		return
+	}
+	sortKey, ok := clientSortKeys[c.DefaultQuery("sort", "total")]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "sort must be total, monthly, upload or download"})
+		return
+	}
+
+	clients := stat.Clients.Snapshot()
+	keys := make([]string, 0, len(clients))
+	for key := range clients {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := sortKey(clients[keys[i]]), sortKey(clients[keys[j]])
+		if a != b {
+			return a > b
+		}
+		return keys[i] < keys[j]
+	})
+	if top > 0 && len(keys) > top {
+		keys = keys[:top]
+	}
+
+	response := ClientsResponse{
+		Name:         name,
+		Total:        len(clients),
+		Evicted:      stat.Clients.Evicted(),
+		Limit:        stat.ClientLimit,
+		LimitMonthly: stat.ClientLimitMonthly,
+		OnExceed:     stat.ClientOnExceed,
+		Clients:      make([]ClientData, 0, len(keys)),
+	}
+	for _, key := range keys {
+		t := clients[key]
+		total := t.Upload + t.Download
+		monthly := t.MonthlyUpload + t.MonthlyDownload
+		response.Clients = append(response.Clients, ClientData{
+			Client:      key,
+			TrafficData: newTrafficData(stats.Traffic{Upload: t.Upload, Download: t.Download}),
+			Monthly: MonthlyData{
+				Month:         t.CurrentMonth,
+				Upload:        t.MonthlyUpload,
+				Download:      t.MonthlyDownload,
+				UploadHuman:   stats.FormatBytes(t.MonthlyUpload),
+				DownloadHuman: stats.FormatBytes(t.MonthlyDownload),
+			},
+			Usage:         newUsageData(total, stat.ClientLimit),
+			UsageMonthly:  newUsageData(monthly, stat.ClientLimitMonthly),
+			LimitExceeded: (stat.ClientLimit > 0 && total >= stat.ClientLimit) || (stat.ClientLimitMonthly > 0 && monthly >= stat.ClientLimitMonthly),
+			LastSeen:      time.Unix(t.LastSeen, 0),
+		})
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+func (s *Server) handleConnections(c *gin.Context) {
+	name := c.Param("name")
+	table := s.registry.Get(name)
+	if table == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "proxy not found"})
+		return
+	}
+
+	flows := table.List()
+	response := ConnectionsResponse{
+		Name:        name,
+		Connections: make([]ConnectionResponse, 0, len(flows)),
+	}
+
+	for _, f := range flows {
+		upload := f.Upload()
+		download := f.Download()
+		response.Connections = append(response.Connections, ConnectionResponse{
+			ID:            f.ID,
+			Protocol:      f.Protocol,
+			ClientAddr:    f.ClientAddr,
+			TargetAddr:    f.TargetAddr,
+			StartTime:     f.StartTime,
+			LastActive:    f.LastActive(),
+			Upload:        upload,
+			Download:      download,
+			UploadHuman:   stats.FormatBytes(upload),
+			DownloadHuman: stats.FormatBytes(download),
+
+			UploadPackets:   f.UploadPackets(),
+			DownloadPackets: f.DownloadPackets(),
+		})
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+func (s *Server) handleKillConnection(c *gin.Context) {
+	name := c.Param("name")
+	table := s.registry.Get(name)
+	if table == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "proxy not found"})
+		return
+	}
+
+	id := c.Param("id")
+	if !table.Kill(id) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "connection not found"})
+		return
+	}
+
+	log.Printf("[API] Connection %s of proxy %s terminated", id, name)
+	c.JSON(http.StatusOK, gin.H{"status": "terminated", "id": id})
+}
+
+// acl returns the list addressed by the request: a proxy's own list, or the
+// global one for /api/acl.
+func (s *Server) acl(c *gin.Context) *proxy.ACL {
+	if name := c.Param("name"); name != "" {
+		return s.registry.ACL(name)
+	}
+	return s.registry.GlobalACL()
+}
+
+func (s *Server) handleGetACL(c *gin.Context) {
+	acl := s.acl(c)
+	if acl == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "proxy not found"})
+		return
+	}
+
+	var response ACLData
+	response.Allow, response.Deny = acl.Rules()
+	c.JSON(http.StatusOK, response)
+}
+
+func (s *Server) handleSetACL(c *gin.Context) {
+	acl := s.acl(c)
+	if acl == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "proxy not found"})
+		return
+	}
+
+	var request ACLData
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	allow, err := proxy.ParseCIDRs(request.Allow)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid allow: " + err.Error()})
+		return
+	}
+	deny, err := proxy.ParseCIDRs(request.Deny)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid deny: " + err.Error()})
+		return
+	}
+	acl.Set(allow, deny)
+
+	name := c.Param("name")
+	if name == "" {
+		name = "global"
+	}
+	log.Printf("[API] Access control list of %s updated: %d allow, %d deny rules", name, len(allow), len(deny))
+
+	var response ACLData
+	response.Allow, response.Deny = acl.Rules()
+	c.JSON(http.StatusOK, response)
+}
+
+func (s *Server) handleBans(c *gin.Context) {
+	c.JSON(http.StatusOK, BansResponse{Bans: s.registry.Bans().List()})
+}
+
+func (s *Server) handleBan(c *gin.Context) {
+	var request BanRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ip := net.ParseIP(request.IP)
+	if ip == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid ip"})
+		return
+	}
+	var duration time.Duration
+	if request.Duration != "" {
+		var err error
+		duration, err = time.ParseDuration(request.Duration)
+		if err != nil || duration <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid duration"})
+			return
+		}
+	}
+	if request.Reason == "" {
+		request.Reason = "banned via API"
+	}
+
+	c.JSON(http.StatusOK, s.registry.Bans().Ban(ip.String(), duration, request.Reason))
+}
+
+func (s *Server) handleUnban(c *gin.Context) {
+	ip := net.ParseIP(c.Param("ip"))
+	if ip == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid ip"})
+		return
+	}
+	if !s.registry.Bans().Unban(ip.String()) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "ip not banned"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "unbanned", "ip": ip.String()})
+}
+
+func (s *Server) handleAccessLog(c *gin.Context) {
+	accessLog := s.registry.AccessLog()
+	if accessLog == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "access log disabled"})
+		return
+	}
+
+	filter := proxy.AccessLogFilter{Proxy: c.Query("proxy")}
+	var err error
+	filter.Limit, err = strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || filter.Limit < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a non-negative number"})
+		return
+	}
+	if ip := c.Query("ip"); ip != "" {
+		nets, err := proxy.ParseCIDRs([]string{ip})
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "ip must be an IP address or CIDR"})
+			return
+		}
+		filter.Client = nets[0]
+	}
+	for param, t := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if value := c.Query(param); value != "" {
+			if *t, err = time.Parse(time.RFC3339, value); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": param + " must be an RFC 3339 time"})
+				return
+			}
+		}
+	}
+
+	c.JSON(http.StatusOK, AccessLogResponse{Entries: accessLog.Search(filter)})
+}
+
+func newTrafficData(t stats.Traffic) TrafficData {
+	return TrafficData{
+		Upload:        t.Upload,
+		Download:      t.Download,
+		UploadHuman:   stats.FormatBytes(t.Upload),
+		DownloadHuman: stats.FormatBytes(t.Download),
+	}
+}
+
 func (s *Server) convertToResponse(stat *stats.ProxyStats) ProxyStatsResponse {
 	totalUpload := atomic.LoadInt64(&stat.TotalUpload)
 	totalDownload := atomic.LoadInt64(&stat.TotalDownload)
@@ -210,49 +656,88 @@ func (s *Server) convertToResponse(stat *stats.ProxyStats) ProxyStatsResponse {
 		LimitMonthly:         limitMonthly,
 		LimitMonthlyHuman:    limitMonthlyHuman,
 		LimitMonthlyExceeded: stat.IsMonthlyLimitExceeded(),
+		OnExceed:             stat.OnExceed,
+		ActivePolicy:         stat.ActivePolicy(),
+		ActiveConnections:    atomic.LoadInt64(&stat.ActiveConnections),
+		ActiveUDPSessions:    atomic.LoadInt64(&stat.ActiveUDPSessions),
+		Rejected:             stat.Rejected.Snapshot(),
+		Errors:               stat.Errors.Snapshot(),
 	}
 
-	// Total usage
-	if limit > 0 {
-		used := totalUpload + totalDownload
-		remaining := limit - used
-		if remaining < 0 {
-			remaining = 0
-		}
-		percentage := float64(used) / float64(limit) * 100
-		if percentage > 100 {
-			percentage = 100
-		}
+	if stat.Protocol != "tcp" {
+		udpSessions := stat.UDPSessions.Snapshot()
+		resp.UDPSessions = &udpSessions
+	}
 
-		resp.Usage = &UsageData{
-			Used:           used,
-			UsedHuman:      stats.FormatBytes(used),
-			Remaining:      remaining,
-			RemainingHuman: stats.FormatBytes(remaining),
-			Percentage:     float64(int(percentage*100)) / 100,
-		}
+	if overhead := stat.TLSOverhead.Snapshot(); overhead.Upload > 0 || overhead.Download > 0 {
+		tlsOverhead := newTrafficData(overhead)
+		resp.TLSOverhead = &tlsOverhead
 	}
 
-	// Monthly usage
-	if limitMonthly > 0 {
-		used := monthlyUpload + monthlyDownload
-		remaining := limitMonthly - used
-		if remaining < 0 {
-			remaining = 0
-		}
-		percentage := float64(used) / float64(limitMonthly) * 100
-		if percentage > 100 {
-			percentage = 100
-		}
+	targets := stat.Targets.Snapshot()
+	for addr, t := range targets {
+		resp.Targets = append(resp.Targets, TargetData{
+			Address:     addr,
+			TrafficData: newTrafficData(t),
+		})
+	}
+	sort.Slice(resp.Targets, func(i, j int) bool {
+		return resp.Targets[i].Address < resp.Targets[j].Address
+	})
+
+	for protocol, t := range stat.Protocols.Snapshot() {
+		resp.Protocols = append(resp.Protocols, ProtocolData{
+			Protocol:    protocol,
+			TrafficData: newTrafficData(t),
+		})
+	}
+	sort.Slice(resp.Protocols, func(i, j int) bool {
+		return resp.Protocols[i].Protocol < resp.Protocols[j].Protocol
+	})
+
+	for family, t := range stat.Families.Snapshot() {
+		resp.AddressFamilies = append(resp.AddressFamilies, FamilyData{
+			Family:      family,
+			TrafficData: newTrafficData(t),
+		})
+	}
+	sort.Slice(resp.AddressFamilies, func(i, j int) bool {
+		return resp.AddressFamilies[i].Family < resp.AddressFamilies[j].Family
+	})
 
-		resp.UsageMonthly = &UsageData{
-			Used:           used,
-			UsedHuman:      stats.FormatBytes(used),
-			Remaining:      remaining,
-			RemainingHuman: stats.FormatBytes(remaining),
-			Percentage:     float64(int(percentage*100)) / 100,
+	for _, b := range s.registry.Balancer(stat.Name) {
+		if b.HealthChecked() {
+			resp.Health = append(resp.Health, targetHealth(b)...)
 		}
 	}
 
+	resp.Usage = newUsageData(totalUpload+totalDownload, limit)
+	resp.UsageMonthly = newUsageData(monthlyUpload+monthlyDownload, limitMonthly)
+
 	return resp
 }
+
+// newUsageData reports used bytes against limit, or nil if there is no
+// limit.
+func newUsageData(used, limit int64) *UsageData {
+	if limit <= 0 {
+		return nil
+	}
+
+	remaining := limit - used
+	if remaining < 0 {
+		remaining = 0
+	}
+	percentage := float64(used) / float64(limit) * 100
+	if percentage > 100 {
+		percentage = 100
+	}
+
+	return &UsageData{
+		Used:           used,
+		UsedHuman:      stats.FormatBytes(used),
+		Remaining:      remaining,
+		RemainingHuman: stats.FormatBytes(remaining),
+		Percentage:     float64(int(percentage*100)) / 100,
+	}
+}
@@ -2,14 +2,41 @@ package config
 
 import (
 	"os"
+	"path/filepath"
 
 	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
-	API      APIConfig     `yaml:"api"`
-	DataFile string        `yaml:"data_file"`
-	Proxies  []ProxyConfig `yaml:"proxies"`
+	API             APIConfig        `yaml:"api"`
+	DataFile        string           `yaml:"data_file"`
+	ShutdownTimeout string           `yaml:"shutdown_timeout"` // how long to drain connections on shutdown, e.g., "30s"
+	Allow           []string         `yaml:"allow"`            // CIDRs allowed to use any proxy, empty = all
+	Deny            []string         `yaml:"deny"`             // CIDRs refused by every proxy
+	Ban             BanConfig        `yaml:"ban"`
+	AccessLog       *AccessLogConfig `yaml:"access_log"` // JSON line per finished connection, nil = disabled
+	Proxies         []ProxyConfig    `yaml:"proxies"`
+}
+
+// BanConfig bans client IPs that cause more than the given number of events
+// of a kind within the window, across all proxies.
+type BanConfig struct {
+	Connections    int    `yaml:"connections"`      // new TCP connections and UDP sessions, 0 = not watched
+	DialErrors     int    `yaml:"dial_errors"`      // failed dials to a target, 0 = not watched
+	Rejections     int    `yaml:"rejections"`       // refused by max_connections_per_ip or client_limit, 0 = not watched
+	ShortLived     int    `yaml:"short_lived"`      // TCP connections closed within short_lived_time, 0 = not watched
+	ShortLivedTime string `yaml:"short_lived_time"` // e.g., "1s"
+	Window         string `yaml:"window"`           // period events are counted over, e.g., "1m"
+	Duration       string `yaml:"duration"`         // how long an IP stays banned, e.g., "10m"
+	DataFile       string `yaml:"data_file"`        // where bans are saved, default bans.json next to data_file
+}
+
+type AccessLogConfig struct {
+	File           string `yaml:"file"`            // default access.log next to data_file
+	MaxSize        string `yaml:"max_size"`        // rotate once the file reaches this size, e.g., "100MB", 0 = never
+	RotateInterval string `yaml:"rotate_interval"` // rotate files older than this, e.g., "24h", 0 = never
+	MaxBackups     int    `yaml:"max_backups"`     // rotated files kept, 0 = all
+	Recent         int    `yaml:"recent"`          // entries kept in memory for the search API
 }
 
 type APIConfig struct {
@@ -17,6 +44,70 @@ type APIConfig struct {
 	Token string `yaml:"token"`
 }
 
+type TargetConfig struct {
+	Host   string `yaml:"host"`
+	Port   int    `yaml:"port"`
+	Weight int    `yaml:"weight"` // relative share of new connections, default 1
+}
+
+type HealthCheckConfig struct {
+	Type     string `yaml:"type"`     // tcp (connect) or udp (request/response)
+	Interval string `yaml:"interval"` // e.g., "5s"
+	Timeout  string `yaml:"timeout"`  // e.g., "2s"
+	Rise     int    `yaml:"rise"`     // consecutive successes to mark a target up
+	Fall     int    `yaml:"fall"`     // consecutive failures to mark a target down
+	Send     string `yaml:"send"`     // UDP probe payload, required for type udp
+	Expect   string `yaml:"expect"`   // substring expected in the UDP reply, empty = any reply
+}
+
+type TLSConfig struct {
+	CertFile     string   `yaml:"cert_file"`
+	KeyFile      string   `yaml:"key_file"`
+	MinVersion   string   `yaml:"min_version"`    // "1.0" to "1.3", default "1.2"
+	ClientCAFile string   `yaml:"client_ca_file"` // require client certificates signed by this CA (mTLS)
+	ALPN         []string `yaml:"alpn"`           // protocols offered to clients, e.g., ["h2", "http/1.1"]
+}
+
+type TargetTLSConfig struct {
+	ServerName         string `yaml:"server_name"`          // SNI and verified name, default = target host
+	CAFile             string `yaml:"ca_file"`              // CA bundle to verify targets, default = system roots
+	CertFile           string `yaml:"cert_file"`            // client certificate presented to targets
+	KeyFile            string `yaml:"key_file"`             // key for cert_file
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"` // do not verify target certificates
+}
+
+type RouteConfig struct {
+	Name         string         `yaml:"name"` // stats name, must be unique across proxies and routes
+	SNI          []string       `yaml:"sni"`  // hostnames, "*.example.com" matches any subdomain
+	TargetHost   string         `yaml:"target_host"`
+	TargetPort   int            `yaml:"target_port"`
+	Targets      []TargetConfig `yaml:"targets"`
+	LoadBalance  string         `yaml:"load_balance"`
+	Limit        string         `yaml:"limit"`         // total limit for this route, 0 = unlimited
+	LimitMonthly string         `yaml:"limit_monthly"` // monthly limit for this route, 0 = unlimited
+}
+
+type SniffConfig struct {
+	Timeout string         `yaml:"timeout"` // how long to wait for the client's first bytes, e.g., "2s"
+	SSH     []TargetConfig `yaml:"ssh"`     // targets per detected protocol, empty = proxy's own targets
+	HTTP    []TargetConfig `yaml:"http"`
+	TLS     []TargetConfig `yaml:"tls"`
+	SOCKS5  []TargetConfig `yaml:"socks5"`
+}
+
+type ClientStatsConfig struct {
+	IPv4Prefix int `yaml:"ipv4_prefix"` // group IPv4 clients by this prefix length, default 32 (per address)
+	IPv6Prefix int `yaml:"ipv6_prefix"` // group IPv6 clients by this prefix length, default 64
+	MaxClients int `yaml:"max_clients"` // entries kept, the least active are evicted beyond, default 10000
+}
+
+type ClientLimitConfig struct {
+	Limit        string `yaml:"limit"`         // total limit per client, e.g., "100GB", 0 = unlimited
+	LimitMonthly string `yaml:"limit_monthly"` // monthly limit per client, e.g., "10GB", 0 = unlimited
+	OnExceed     string `yaml:"on_exceed"`     // block, throttle, or alert_only
+	ThrottleRate string `yaml:"throttle_rate"` // per client rate for on_exceed: throttle, e.g., "1Mbps"
+}
+
 type ProxyConfig struct {
 	Name         string `yaml:"name"`
 	ListenPort   int    `yaml:"listen_port"`
@@ -25,6 +116,55 @@ type ProxyConfig struct {
 	Protocol     string `yaml:"protocol"`      // tcp, udp, or both
 	Limit        string `yaml:"limit"`         // total limit, e.g., "100GB", "1TB", 0 = unlimited
 	LimitMonthly string `yaml:"limit_monthly"` // monthly limit, e.g., "100GB", "1TB", 0 = unlimited
+	LimitCheck   string `yaml:"limit_check"`   // re-check limits on active connections every N bytes, e.g., "1MB", 0 = every read
+	OnExceed     string `yaml:"on_exceed"`     // block, throttle, or alert_only
+	ThrottleRate string `yaml:"throttle_rate"` // fallback rate for on_exceed: throttle, e.g., "1Mbps"
+
+	ListenPorts string `yaml:"listen_ports"` // ports and ranges, e.g., "27000-27050" or "80,443", replaces listen_port
+	TargetPorts string `yaml:"target_ports"` // target port for each listen port, default = target_port, or the same port if neither it nor the targets set one
+
+	ListenAddress string `yaml:"listen_address"` // IP address or interface to bind, empty = all addresses (dual-stack)
+	DialPolicy    string `yaml:"dial_policy"`    // prefer_ipv4, prefer_ipv6, ipv4_only, or ipv6_only, empty = resolver order
+
+	SourceAddress string `yaml:"source_address"` // local IP for connections to targets, empty = chosen by the kernel
+	BindInterface string `yaml:"bind_interface"` // bind connections to targets to this interface (SO_BINDTODEVICE, Linux)
+	FWMark        int    `yaml:"fwmark"`         // firewall mark for connections to targets (SO_MARK, Linux), 0 = none
+
+	Targets     []TargetConfig `yaml:"targets"`      // multiple targets, replaces target_host/target_port
+	LoadBalance string         `yaml:"load_balance"` // round_robin, least_conn, random, or hash (client IP)
+
+	HealthCheck  *HealthCheckConfig `yaml:"health_check"`  // active target health checks, nil = disabled
+	BackupTarget *TargetConfig      `yaml:"backup_target"` // used while no target is healthy
+
+	TLS       *TLSConfig       `yaml:"tls"`        // terminate TLS on the TCP listener
+	TargetTLS *TargetTLSConfig `yaml:"target_tls"` // connect to targets over TLS
+
+	Routes []RouteConfig `yaml:"routes"` // route TCP connections by TLS SNI, unmatched ones use the proxy's own targets
+	Sniff  *SniffConfig  `yaml:"sniff"`  // detect the protocol of TCP connections, nil = disabled
+
+	Allow []string `yaml:"allow"` // CIDRs allowed to use this proxy, empty = all
+	Deny  []string `yaml:"deny"`  // CIDRs refused by this proxy, checked before allow
+
+	ClientStats *ClientStatsConfig `yaml:"client_stats"` // per-client traffic accounting, nil = disabled
+	ClientLimit *ClientLimitConfig `yaml:"client_limit"` // quota for each client, enables client_stats
+
+	RateLimitUpload   string `yaml:"rate_limit_upload"`   // e.g., "10Mbps", "1MB/s", 0 = unlimited
+	RateLimitDownload string `yaml:"rate_limit_download"` // e.g., "10Mbps", "1MB/s", 0 = unlimited
+	RateLimitBurst    string `yaml:"rate_limit_burst"`    // bucket size, e.g., "1MB", 0 = one second of traffic
+
+	DisableZeroCopy bool `yaml:"disable_zero_copy"` // forward through userspace buffers instead of splice(2) on Linux
+
+	MaxConnections      int `yaml:"max_connections"`        // concurrent TCP connections, 0 = unlimited
+	MaxConnectionsPerIP int `yaml:"max_connections_per_ip"` // concurrent TCP connections per client IP, 0 = unlimited
+	MaxUDPSessions      int `yaml:"max_udp_sessions"`       // concurrent UDP client sessions, 0 = unlimited
+
+	UDPTimeout         string `yaml:"udp_timeout"`          // close UDP sessions idle for this long, e.g., "30s"
+	UDPCleanupInterval string `yaml:"udp_cleanup_interval"` // min time between idle checks of a UDP session, e.g., "1s"
+	UDPBufferSize      string `yaml:"udp_buffer_size"`      // largest UDP datagram forwarded, e.g., "2KB", 0 = 64KB
+
+	SendProxyProtocol    string   `yaml:"send_proxy_protocol"`    // PROXY protocol header sent to the target: v1 or v2 (v2 only for UDP)
+	AcceptProxyProtocol  bool     `yaml:"accept_proxy_protocol"`  // read PROXY v1/v2 headers from trusted upstreams (TCP only)
+	ProxyProtocolTrusted []string `yaml:"proxy_protocol_trusted"` // CIDRs allowed to send PROXY headers, required with accept_proxy_protocol
 }
 
 func Load(path string) (*Config, error) {
@@ -45,6 +185,35 @@ func Load(path string) (*Config, error) {
 	if cfg.DataFile == "" {
 		cfg.DataFile = "./traffic_data.json"
 	}
+	if cfg.ShutdownTimeout == "" {
+		cfg.ShutdownTimeout = "10s"
+	}
+	if cfg.Ban.ShortLivedTime == "" {
+		cfg.Ban.ShortLivedTime = "1s"
+	}
+	if cfg.Ban.Window == "" {
+		cfg.Ban.Window = "1m"
+	}
+	if cfg.Ban.Duration == "" {
+		cfg.Ban.Duration = "10m"
+	}
+	if cfg.Ban.DataFile == "" {
+		cfg.Ban.DataFile = filepath.Join(filepath.Dir(cfg.DataFile), "bans.json")
+	}
+	if al := cfg.AccessLog; al != nil {
+		if al.File == "" {
+			al.File = filepath.Join(filepath.Dir(cfg.DataFile), "access.log")
+		}
+		if al.MaxSize == "" {
+			al.MaxSize = "100MB"
+		}
+		if al.RotateInterval == "" {
+			al.RotateInterval = "24h"
+		}
+		if al.Recent == 0 {
+			al.Recent = 10000
+		}
+	}
 
 	for i := range cfg.Proxies {
 		if cfg.Proxies[i].Protocol == "" {
@@ -53,6 +222,96 @@ func Load(path string) (*Config, error) {
 		if cfg.Proxies[i].TargetHost == "" {
 			cfg.Proxies[i].TargetHost = "127.0.0.1"
 		}
+		// A proxy with routes and no target of its own rejects unmatched connections
+		if len(cfg.Proxies[i].Targets) == 0 && (cfg.Proxies[i].TargetPort != 0 || len(cfg.Proxies[i].Routes) == 0) {
+			cfg.Proxies[i].Targets = []TargetConfig{{
+				Host: cfg.Proxies[i].TargetHost,
+				Port: cfg.Proxies[i].TargetPort,
+			}}
+		}
+		for j := range cfg.Proxies[i].Targets {
+			if cfg.Proxies[i].Targets[j].Host == "" {
+				cfg.Proxies[i].Targets[j].Host = "127.0.0.1"
+			}
+		}
+		for j := range cfg.Proxies[i].Routes {
+			r := &cfg.Proxies[i].Routes[j]
+			if r.TargetHost == "" {
+				r.TargetHost = "127.0.0.1"
+			}
+			if len(r.Targets) == 0 {
+				r.Targets = []TargetConfig{{Host: r.TargetHost, Port: r.TargetPort}}
+			}
+			for k := range r.Targets {
+				if r.Targets[k].Host == "" {
+					r.Targets[k].Host = "127.0.0.1"
+				}
+			}
+		}
+		if sn := cfg.Proxies[i].Sniff; sn != nil {
+			if sn.Timeout == "" {
+				sn.Timeout = "2s"
+			}
+			for _, targets := range [][]TargetConfig{sn.SSH, sn.HTTP, sn.TLS, sn.SOCKS5} {
+				for k := range targets {
+					if targets[k].Host == "" {
+						targets[k].Host = "127.0.0.1"
+					}
+				}
+			}
+		}
+		if cl := cfg.Proxies[i].ClientLimit; cl != nil {
+			if cl.OnExceed == "" {
+				cl.OnExceed = "block"
+			}
+			// Quotas are checked against the per-client counters
+			if cfg.Proxies[i].ClientStats == nil {
+				cfg.Proxies[i].ClientStats = &ClientStatsConfig{}
+			}
+		}
+		if cs := cfg.Proxies[i].ClientStats; cs != nil {
+			if cs.IPv4Prefix == 0 {
+				cs.IPv4Prefix = 32
+			}
+			if cs.IPv6Prefix == 0 {
+				cs.IPv6Prefix = 64
+			}
+			if cs.MaxClients == 0 {
+				cs.MaxClients = 10000
+			}
+		}
+		if bt := cfg.Proxies[i].BackupTarget; bt != nil && bt.Host == "" {
+			bt.Host = "127.0.0.1"
+		}
+		if hc := cfg.Proxies[i].HealthCheck; hc != nil {
+			if hc.Type == "" {
+				hc.Type = "tcp"
+				if cfg.Proxies[i].Protocol == "udp" {
+					hc.Type = "udp"
+				}
+			}
+			if hc.Interval == "" {
+				hc.Interval = "5s"
+			}
+			if hc.Timeout == "" {
+				hc.Timeout = "2s"
+			}
+			if hc.Rise <= 0 {
+				hc.Rise = 2
+			}
+			if hc.Fall <= 0 {
+				hc.Fall = 3
+			}
+		}
+		if cfg.Proxies[i].OnExceed == "" {
+			cfg.Proxies[i].OnExceed = "block"
+		}
+		if cfg.Proxies[i].UDPTimeout == "" {
+			cfg.Proxies[i].UDPTimeout = "60s"
+		}
+		if cfg.Proxies[i].UDPCleanupInterval == "" {
+			cfg.Proxies[i].UDPCleanupInterval = "1s"
+		}
 	}
 
 	return &cfg, nil
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"log"
+	"net"
 	"os"
 	"os/signal"
+	"runtime"
+	"strconv"
+	"sync"
 	"syscall"
 	"time"
 
@@ -28,6 +33,11 @@ func main() {
 		log.Fatalf("Failed to load config: %v", err)
 	}
 
+	shutdownTimeout, err := time.ParseDuration(cfg.ShutdownTimeout)
+	if err != nil {
+		log.Fatalf("Failed to parse shutdown_timeout: %v", err)
+	}
+
 	statsManager := stats.NewStatsManager()
 
 	persistence := stats.NewPersistence(cfg.DataFile, statsManager)
@@ -35,7 +45,65 @@ func main() {
 		log.Printf("Warning: Failed to load persisted stats: %v", err)
 	}
 
+	registry := proxy.NewRegistry()
+
+	globalAllow, err := proxy.ParseCIDRs(cfg.Allow)
+	if err != nil {
+		log.Fatalf("Failed to parse allow: %v", err)
+	}
+	globalDeny, err := proxy.ParseCIDRs(cfg.Deny)
+	if err != nil {
+		log.Fatalf("Failed to parse deny: %v", err)
+	}
+	globalACL := proxy.NewACL(globalAllow, globalDeny)
+	registry.SetGlobalACL(globalACL)
+
+	banRules := proxy.BanRules{}
+	banRules.Thresholds[proxy.BanConnections] = cfg.Ban.Connections
+	banRules.Thresholds[proxy.BanDialErrors] = cfg.Ban.DialErrors
+	banRules.Thresholds[proxy.BanRejections] = cfg.Ban.Rejections
+	banRules.Thresholds[proxy.BanShortLived] = cfg.Ban.ShortLived
+	if banRules.ShortLived, err = time.ParseDuration(cfg.Ban.ShortLivedTime); err != nil {
+		log.Fatalf("Failed to parse ban short_lived_time: %v", err)
+	}
+	if banRules.Window, err = time.ParseDuration(cfg.Ban.Window); err != nil {
+		log.Fatalf("Failed to parse ban window: %v", err)
+	}
+	if banRules.Duration, err = time.ParseDuration(cfg.Ban.Duration); err != nil {
+		log.Fatalf("Failed to parse ban duration: %v", err)
+	}
+	if banRules.Window <= 0 || banRules.Duration <= 0 {
+		log.Fatalf("Ban window and duration must be positive")
+	}
+	bans := proxy.NewBanner(banRules, cfg.Ban.DataFile)
+	if err := bans.Load(); err != nil {
+		log.Printf("Warning: Failed to load bans: %v", err)
+	}
+	registry.SetBans(bans)
+
+	var accessLog *proxy.AccessLog
+	if al := cfg.AccessLog; al != nil {
+		maxSize, err := stats.ParseBytes(al.MaxSize)
+		if err != nil {
+			log.Fatalf("Failed to parse access_log max_size: %v", err)
+		}
+		rotateInterval, err := time.ParseDuration(al.RotateInterval)
+		if err != nil {
+			log.Fatalf("Failed to parse access_log rotate_interval: %v", err)
+		}
+		if al.Recent < 0 || al.MaxBackups < 0 {
+			log.Fatalf("access_log recent and max_backups must not be negative")
+		}
+		accessLog, err = proxy.NewAccessLog(al.File, maxSize, rotateInterval, al.MaxBackups, al.Recent)
+		if err != nil {
+			log.Fatalf("Failed to open access log: %v", err)
+		}
+		registry.SetAccessLog(accessLog)
+		log.Printf("Writing access log to %s", al.File)
+	}
+
 	var proxies []Proxy
+	var balancers []*proxy.Balancer
 
 	for _, p := range cfg.Proxies {
 		limit, err := stats.ParseBytes(p.Limit)
@@ -47,7 +115,180 @@ func main() {
 			log.Fatalf("Failed to parse limit_monthly for proxy %s: %v", p.Name, err)
 		}
 
-		proxyStats := statsManager.Register(p.Name, p.Protocol, p.ListenPort, p.TargetPort, limit, limitMonthly)
+		limitCheck, err := stats.ParseBytes(p.LimitCheck)
+		if err != nil {
+			log.Fatalf("Failed to parse limit_check for proxy %s: %v", p.Name, err)
+		}
+
+		rateUpload, err := stats.ParseRate(p.RateLimitUpload)
+		if err != nil {
+			log.Fatalf("Failed to parse rate_limit_upload for proxy %s: %v", p.Name, err)
+		}
+		rateDownload, err := stats.ParseRate(p.RateLimitDownload)
+		if err != nil {
+			log.Fatalf("Failed to parse rate_limit_download for proxy %s: %v", p.Name, err)
+		}
+		rateBurst, err := stats.ParseBytes(p.RateLimitBurst)
+		if err != nil {
+			log.Fatalf("Failed to parse rate_limit_burst for proxy %s: %v", p.Name, err)
+		}
+
+		throttleRate, err := stats.ParseRate(p.ThrottleRate)
+		if err != nil {
+			log.Fatalf("Failed to parse throttle_rate for proxy %s: %v", p.Name, err)
+		}
+		switch p.OnExceed {
+		case stats.PolicyBlock, stats.PolicyAlertOnly:
+		case stats.PolicyThrottle:
+			if throttleRate <= 0 {
+				log.Fatalf("Proxy %s uses on_exceed: throttle but has no throttle_rate", p.Name)
+			}
+		default:
+			log.Fatalf("Unknown on_exceed policy %s for proxy %s", p.OnExceed, p.Name)
+		}
+
+		var sendProxyProtocol int
+		switch p.SendProxyProtocol {
+		case "":
+		case "v1":
+			if p.Protocol != "tcp" {
+				log.Fatalf("Proxy %s: send_proxy_protocol v1 is not supported for UDP, use v2", p.Name)
+			}
+			sendProxyProtocol = proxy.ProxyProtocolV1
+		case "v2":
+			sendProxyProtocol = proxy.ProxyProtocolV2
+		default:
+			log.Fatalf("Unknown send_proxy_protocol %s for proxy %s", p.SendProxyProtocol, p.Name)
+		}
+
+		udpTimeout, err := time.ParseDuration(p.UDPTimeout)
+		if err != nil {
+			log.Fatalf("Failed to parse udp_timeout for proxy %s: %v", p.Name, err)
+		}
+		udpCleanupInterval, err := time.ParseDuration(p.UDPCleanupInterval)
+		if err != nil {
+			log.Fatalf("Failed to parse udp_cleanup_interval for proxy %s: %v", p.Name, err)
+		}
+		udpBufferSize, err := stats.ParseBytes(p.UDPBufferSize)
+		if err != nil {
+			log.Fatalf("Failed to parse udp_buffer_size for proxy %s: %v", p.Name, err)
+		}
+		if udpBufferSize > 65535 {
+			log.Fatalf("Proxy %s: udp_buffer_size must not exceed 65535 bytes", p.Name)
+		}
+
+		var clientLimit, clientLimitMonthly, clientThrottleRate int64
+		var clientOnExceed string
+		if cl := p.ClientLimit; cl != nil {
+			clientOnExceed = cl.OnExceed
+			clientLimit, err = stats.ParseBytes(cl.Limit)
+			if err != nil {
+				log.Fatalf("Failed to parse client_limit limit for proxy %s: %v", p.Name, err)
+			}
+			clientLimitMonthly, err = stats.ParseBytes(cl.LimitMonthly)
+			if err != nil {
+				log.Fatalf("Failed to parse client_limit limit_monthly for proxy %s: %v", p.Name, err)
+			}
+			clientThrottleRate, err = stats.ParseRate(cl.ThrottleRate)
+			if err != nil {
+				log.Fatalf("Failed to parse client_limit throttle_rate for proxy %s: %v", p.Name, err)
+			}
+			switch cl.OnExceed {
+			case stats.PolicyBlock, stats.PolicyAlertOnly:
+			case stats.PolicyThrottle:
+				if clientThrottleRate <= 0 {
+					log.Fatalf("Proxy %s uses client_limit on_exceed: throttle but has no throttle_rate", p.Name)
+				}
+			default:
+				log.Fatalf("Unknown client_limit on_exceed policy %s for proxy %s", cl.OnExceed, p.Name)
+			}
+		}
+
+		var clientStats *proxy.ClientPrefix
+		if cs := p.ClientStats; cs != nil {
+			if cs.IPv4Prefix < 1 || cs.IPv4Prefix > 32 || cs.IPv6Prefix < 1 || cs.IPv6Prefix > 128 {
+				log.Fatalf("Proxy %s: client_stats prefixes must be 1-32 for IPv4 and 1-128 for IPv6", p.Name)
+			}
+			clientStats = &proxy.ClientPrefix{IPv4: cs.IPv4Prefix, IPv6: cs.IPv6Prefix}
+		}
+
+		allow, err := proxy.ParseCIDRs(p.Allow)
+		if err != nil {
+			log.Fatalf("Failed to parse allow for proxy %s: %v", p.Name, err)
+		}
+		deny, err := proxy.ParseCIDRs(p.Deny)
+		if err != nil {
+			log.Fatalf("Failed to parse deny for proxy %s: %v", p.Name, err)
+		}
+		acl := proxy.NewACL(allow, deny)
+		registry.SetACL(p.Name, acl)
+
+		proxyProtocolTrusted, err := proxy.ParseCIDRs(p.ProxyProtocolTrusted)
+		if err != nil {
+			log.Fatalf("Failed to parse proxy_protocol_trusted for proxy %s: %v", p.Name, err)
+		}
+		if p.AcceptProxyProtocol && len(proxyProtocolTrusted) == 0 {
+			// Anyone could forge a client address and get past the ACL and limits
+			log.Fatalf("Proxy %s: accept_proxy_protocol requires proxy_protocol_trusted", p.Name)
+		}
+
+		listenPorts := []int{p.ListenPort}
+		if p.ListenPorts != "" {
+			if p.ListenPort != 0 {
+				log.Fatalf("Proxy %s: set either listen_port or listen_ports", p.Name)
+			}
+			listenPorts, err = proxy.ParsePorts(p.ListenPorts)
+			if err != nil {
+				log.Fatalf("Failed to parse listen_ports for proxy %s: %v", p.Name, err)
+			}
+		}
+
+		// targetPorts[i] is the target port for listenPorts[i], 0 = the configured target port
+		targetPorts := make([]int, len(listenPorts))
+		if p.TargetPorts != "" {
+			ports, err := proxy.ParsePorts(p.TargetPorts)
+			if err != nil {
+				log.Fatalf("Failed to parse target_ports for proxy %s: %v", p.Name, err)
+			}
+			if len(ports) != len(listenPorts) {
+				log.Fatalf("Proxy %s: target_ports has %d ports, listen_ports has %d", p.Name, len(ports), len(listenPorts))
+			}
+			copy(targetPorts, ports)
+		} else if p.ListenPorts != "" && p.TargetPort == 0 && !hasTargetPort(&p) {
+			// Without a target port, each port is forwarded to the same port on the target
+			copy(targetPorts, listenPorts)
+		}
+
+		listenHosts, err := proxy.ListenHosts(p.ListenAddress)
+		if err != nil {
+			log.Fatalf("Failed to resolve listen_address for proxy %s: %v", p.Name, err)
+		}
+
+		switch p.DialPolicy {
+		case "", proxy.DialPreferIPv4, proxy.DialPreferIPv6, proxy.DialIPv4Only, proxy.DialIPv6Only:
+		default:
+			log.Fatalf("Unknown dial_policy %s for proxy %s", p.DialPolicy, p.Name)
+		}
+		dialer := proxy.Dialer{
+			Policy:    p.DialPolicy,
+			Interface: p.BindInterface,
+			Mark:      p.FWMark,
+		}
+		if p.SourceAddress != "" {
+			dialer.SourceAddr = net.ParseIP(p.SourceAddress)
+			if dialer.SourceAddr == nil {
+				log.Fatalf("Invalid source_address %s for proxy %s", p.SourceAddress, p.Name)
+			}
+		}
+		if (p.BindInterface != "" || p.FWMark != 0) && runtime.GOOS != "linux" {
+			log.Fatalf("Proxy %s: bind_interface and fwmark are only supported on Linux", p.Name)
+		}
+
+		proxyStats := statsManager.Register(p.Name, p.Protocol, listenPorts[0], p.TargetPort, limit, limitMonthly, p.OnExceed)
+		if p.ClientStats != nil {
+			proxyStats.Clients.SetMax(p.ClientStats.MaxClients)
+		}
+		proxyStats.SetClientLimits(clientLimit, clientLimitMonthly, clientOnExceed)
 
 		if limit > 0 {
 			log.Printf("[%s] Total limit: %s", p.Name, stats.FormatBytes(limit))
@@ -55,50 +296,249 @@ func main() {
 		if limitMonthly > 0 {
 			log.Printf("[%s] Monthly limit: %s", p.Name, stats.FormatBytes(limitMonthly))
 		}
+		if (limit > 0 || limitMonthly > 0) && p.OnExceed != stats.PolicyBlock {
+			log.Printf("[%s] On exceed: %s", p.Name, p.OnExceed)
+		}
+		if clientLimit > 0 {
+			log.Printf("[%s] Total limit per client: %s", p.Name, stats.FormatBytes(clientLimit))
+		}
+		if clientLimitMonthly > 0 {
+			log.Printf("[%s] Monthly limit per client: %s", p.Name, stats.FormatBytes(clientLimitMonthly))
+		}
+		if rateUpload > 0 {
+			log.Printf("[%s] Upload rate limit: %s", p.Name, stats.FormatRate(rateUpload))
+		}
+		if rateDownload > 0 {
+			log.Printf("[%s] Download rate limit: %s", p.Name, stats.FormatRate(rateDownload))
+		}
+		if len(allow) > 0 || len(deny) > 0 {
+			log.Printf("[%s] Access control: %d allow, %d deny rules", p.Name, len(allow), len(deny))
+		}
+
+		var healthCheck *proxy.HealthCheck
+		if hc := p.HealthCheck; hc != nil {
+			if hc.Type != "tcp" && hc.Type != "udp" {
+				log.Fatalf("Unknown health_check type %s for proxy %s", hc.Type, p.Name)
+			}
+			if hc.Type == "udp" && hc.Send == "" {
+				// Most UDP services ignore an empty datagram, so every target would go down
+				log.Fatalf("Proxy %s: health_check type udp requires send", p.Name)
+			}
+			interval, err := time.ParseDuration(hc.Interval)
+			if err != nil {
+				log.Fatalf("Failed to parse health_check interval for proxy %s: %v", p.Name, err)
+			}
+			timeout, err := time.ParseDuration(hc.Timeout)
+			if err != nil {
+				log.Fatalf("Failed to parse health_check timeout for proxy %s: %v", p.Name, err)
+			}
+			healthCheck = &proxy.HealthCheck{
+				Network:  hc.Type,
+				Interval: interval,
+				Timeout:  timeout,
+				Rise:     hc.Rise,
+				Fall:     hc.Fall,
+				Send:     []byte(hc.Send),
+				Expect:   []byte(hc.Expect),
+				Dialer:   dialer,
+			}
+		}
 
-		switch p.Protocol {
-		case "tcp":
-			tcpProxy := proxy.NewTCPProxy(p.Name, p.ListenPort, p.TargetHost, p.TargetPort, proxyStats)
-			if err := tcpProxy.Start(); err != nil {
-				log.Fatalf("Failed to start TCP proxy %s: %v", p.Name, err)
+		// One balancer per distinct target port; a proxy without targets of
+		// its own only serves its SNI routes
+		portBalancers := make(map[int]*proxy.Balancer)
+		if len(p.Targets) > 0 {
+			for _, port := range targetPorts {
+				if portBalancers[port] != nil {
+					continue
+				}
+				var backup *proxy.Target
+				if p.BackupTarget != nil {
+					backup = newTargets([]config.TargetConfig{*p.BackupTarget}, port)[0]
+				}
+				balancer, err := proxy.NewBalancer(p.LoadBalance, newTargets(p.Targets, port), backup, proxyStats)
+				if err != nil {
+					log.Fatalf("Invalid targets for proxy %s: %v", p.Name, err)
+				}
+				if healthCheck != nil {
+					balancer.StartHealthChecks(p.Name, *healthCheck)
+				}
+				registry.AddBalancer(p.Name, balancer)
+				balancers = append(balancers, balancer)
+				portBalancers[port] = balancer
 			}
-			proxies = append(proxies, tcpProxy)
+		}
 
-		case "udp":
-			udpProxy, err := proxy.NewUDPProxy(p.Name, p.ListenPort, p.TargetHost, p.TargetPort, proxyStats)
+		var routes []*proxy.Route
+		if len(p.Routes) > 0 && p.Protocol != "tcp" {
+			log.Fatalf("Proxy %s: routes are only supported for TCP", p.Name)
+		}
+		for _, r := range p.Routes {
+			if r.Name == "" || len(r.SNI) == 0 {
+				log.Fatalf("Proxy %s: every route needs a name and at least one sni pattern", p.Name)
+			}
+			routeLimit, err := stats.ParseBytes(r.Limit)
 			if err != nil {
-				log.Fatalf("Failed to create UDP proxy %s: %v", p.Name, err)
+				log.Fatalf("Failed to parse limit for route %s: %v", r.Name, err)
 			}
-			if err := udpProxy.Start(); err != nil {
-				log.Fatalf("Failed to start UDP proxy %s: %v", p.Name, err)
+			routeLimitMonthly, err := stats.ParseBytes(r.LimitMonthly)
+			if err != nil {
+				log.Fatalf("Failed to parse limit_monthly for route %s: %v", r.Name, err)
+			}
+			routeStats := statsManager.Register(r.Name, p.Protocol, listenPorts[0], r.TargetPort, routeLimit, routeLimitMonthly, p.OnExceed)
+			if p.ClientStats != nil {
+				routeStats.Clients.SetMax(p.ClientStats.MaxClients)
 			}
-			proxies = append(proxies, udpProxy)
+			routeStats.SetClientLimits(clientLimit, clientLimitMonthly, clientOnExceed)
+			routeBalancer, err := proxy.NewBalancer(r.LoadBalance, newTargets(r.Targets, 0), nil, routeStats)
+			if err != nil {
+				log.Fatalf("Invalid targets for route %s: %v", r.Name, err)
+			}
+			registry.AddBalancer(r.Name, routeBalancer)
+			routes = append(routes, &proxy.Route{
+				Name:    r.Name,
+				SNI:     r.SNI,
+				Targets: routeBalancer,
+				Stats:   routeStats,
+				Conns:   registry.Table(r.Name),
+			})
+		}
 
-		case "both":
-			// TCP and UDP share the same stats
-			tcpProxy := proxy.NewTCPProxy(p.Name, p.ListenPort, p.TargetHost, p.TargetPort, proxyStats)
-			if err := tcpProxy.Start(); err != nil {
-				log.Fatalf("Failed to start TCP proxy %s: %v", p.Name, err)
+		var sniffTargets map[string]*proxy.Balancer
+		var sniffTimeout time.Duration
+		if sn := p.Sniff; sn != nil {
+			if p.Protocol != "tcp" {
+				log.Fatalf("Proxy %s: sniff is only supported for TCP", p.Name)
 			}
-			proxies = append(proxies, tcpProxy)
+			sniffTimeout, err = time.ParseDuration(sn.Timeout)
+			if err != nil {
+				log.Fatalf("Failed to parse sniff timeout for proxy %s: %v", p.Name, err)
+			}
+			sniffTargets = make(map[string]*proxy.Balancer)
+			for protocol, targets := range map[string][]config.TargetConfig{
+				proxy.ProtocolSSH:    sn.SSH,
+				proxy.ProtocolHTTP:   sn.HTTP,
+				proxy.ProtocolTLS:    sn.TLS,
+				proxy.ProtocolSOCKS5: sn.SOCKS5,
+			} {
+				if len(targets) == 0 {
+					continue
+				}
+				sniffTargets[protocol], err = proxy.NewBalancer(p.LoadBalance, newTargets(targets, 0), nil, proxyStats)
+				if err != nil {
+					log.Fatalf("Invalid sniff %s targets for proxy %s: %v", protocol, p.Name, err)
+				}
+			}
+		}
 
-			udpProxy, err := proxy.NewUDPProxy(p.Name, p.ListenPort, p.TargetHost, p.TargetPort, proxyStats)
+		var tlsConfig *tls.Config
+		if p.TLS != nil {
+			if p.Protocol == "udp" {
+				log.Fatalf("Proxy %s: tls is not supported for UDP", p.Name)
+			}
+			tlsConfig, err = proxy.NewServerTLSConfig(p.Name, p.TLS.CertFile, p.TLS.KeyFile, p.TLS.MinVersion, p.TLS.ClientCAFile, p.TLS.ALPN)
 			if err != nil {
-				log.Fatalf("Failed to create UDP proxy %s: %v", p.Name, err)
+				log.Fatalf("Failed to load TLS config for proxy %s: %v", p.Name, err)
 			}
-			if err := udpProxy.Start(); err != nil {
-				log.Fatalf("Failed to start UDP proxy %s: %v", p.Name, err)
+		}
+
+		var targetTLSConfig *tls.Config
+		if t := p.TargetTLS; t != nil {
+			if p.Protocol == "udp" {
+				log.Fatalf("Proxy %s: target_tls is not supported for UDP", p.Name)
 			}
-			proxies = append(proxies, udpProxy)
+			targetTLSConfig, err = proxy.NewClientTLSConfig(t.ServerName, t.CAFile, t.CertFile, t.KeyFile, t.InsecureSkipVerify)
+			if err != nil {
+				log.Fatalf("Failed to load target TLS config for proxy %s: %v", p.Name, err)
+			}
+		}
 
-		default:
-			log.Fatalf("Unknown protocol %s for proxy %s", p.Protocol, p.Name)
+		opts := proxy.Options{
+			LimitCheck:           limitCheck,
+			UploadLimiter:        proxy.NewRateLimiter(rateUpload, rateBurst),
+			DownloadLimiter:      proxy.NewRateLimiter(rateDownload, rateBurst),
+			ConnLimiter:          proxy.NewConnLimiter(p.MaxConnections, p.MaxConnectionsPerIP),
+			MaxUDPSessions:       p.MaxUDPSessions,
+			UDPTimeout:           udpTimeout,
+			UDPCleanupInterval:   udpCleanupInterval,
+			UDPBufferSize:        int(udpBufferSize),
+			Conns:                registry.Table(p.Name),
+			ClientStats:          clientStats,
+			ClientThrottle:       proxy.NewClientThrottle(clientThrottleRate, rateBurst),
+			GlobalACL:            globalACL,
+			ACL:                  acl,
+			Bans:                 bans,
+			AccessLog:            accessLog,
+			SendProxyProtocol:    sendProxyProtocol,
+			AcceptProxyProtocol:  p.AcceptProxyProtocol,
+			ProxyProtocolTrusted: proxyProtocolTrusted,
+			TLS:                  tlsConfig,
+			TargetTLS:            targetTLSConfig,
+			Dialer:               dialer,
+			Routes:               routes,
+			Sniff:                p.Sniff != nil,
+			SniffTargets:         sniffTargets,
+			SniffTimeout:         sniffTimeout,
+			DisableZeroCopy:      p.DisableZeroCopy,
+			ShutdownTimeout:      shutdownTimeout,
+		}
+		if p.OnExceed == stats.PolicyThrottle {
+			opts.ThrottleUpload = proxy.NewRateLimiter(throttleRate, rateBurst)
+			opts.ThrottleDownload = proxy.NewRateLimiter(throttleRate, rateBurst)
+		}
+
+		// All ports of a proxy share its stats, quota and limiters
+		for i, port := range listenPorts {
+			balancer := portBalancers[targetPorts[i]]
+			for _, host := range listenHosts {
+				listenAddr := net.JoinHostPort(host, strconv.Itoa(port))
+
+				switch p.Protocol {
+				case "tcp":
+					tcpProxy := proxy.NewTCPProxy(p.Name, listenAddr, balancer, proxyStats, opts)
+					if err := tcpProxy.Start(); err != nil {
+						log.Fatalf("Failed to start TCP proxy %s: %v", p.Name, err)
+					}
+					proxies = append(proxies, tcpProxy)
+
+				case "udp":
+					udpProxy, err := proxy.NewUDPProxy(p.Name, listenAddr, balancer, proxyStats, opts)
+					if err != nil {
+						log.Fatalf("Failed to create UDP proxy %s: %v", p.Name, err)
+					}
+					if err := udpProxy.Start(); err != nil {
+						log.Fatalf("Failed to start UDP proxy %s: %v", p.Name, err)
+					}
+					proxies = append(proxies, udpProxy)
+
+				case "both":
+					// TCP and UDP share the same stats
+					tcpProxy := proxy.NewTCPProxy(p.Name, listenAddr, balancer, proxyStats, opts)
+					if err := tcpProxy.Start(); err != nil {
+						log.Fatalf("Failed to start TCP proxy %s: %v", p.Name, err)
+					}
+					proxies = append(proxies, tcpProxy)
+
+					udpProxy, err := proxy.NewUDPProxy(p.Name, listenAddr, balancer, proxyStats, opts)
+					if err != nil {
+						log.Fatalf("Failed to create UDP proxy %s: %v", p.Name, err)
+					}
+					if err := udpProxy.Start(); err != nil {
+						log.Fatalf("Failed to start UDP proxy %s: %v", p.Name, err)
+					}
+					proxies = append(proxies, udpProxy)
+
+				default:
+					log.Fatalf("Unknown protocol %s for proxy %s", p.Protocol, p.Name)
+				}
+			}
 		}
 	}
 
 	persistence.Start(30 * time.Second)
+	bans.Start()
 
-	apiServer := api.NewServer(cfg.API.Port, cfg.API.Token, statsManager)
+	apiServer := api.NewServer(cfg.API.Port, cfg.API.Token, statsManager, registry)
 	if err := apiServer.Start(); err != nil {
 		log.Fatalf("Failed to start API server: %v", err)
 	}
@@ -111,11 +551,56 @@ func main() {
 
 	apiServer.Stop()
 
+	// Drain all proxies in parallel, so shutdown takes at most shutdown_timeout
+	var wg sync.WaitGroup
 	for _, p := range proxies {
-		p.Stop()
+		wg.Add(1)
+		go func(p Proxy) {
+			defer wg.Done()
+			p.Stop()
+		}(p)
+	}
+	wg.Wait()
+
+	for _, b := range balancers {
+		b.Stop()
 	}
 
+	// All connections are closed and counters have settled
 	persistence.Stop()
+	bans.Stop()
+	if accessLog != nil {
+		accessLog.Close()
+	}
 
 	log.Println("Shutdown complete")
 }
+
+// newTargets builds targets from their config. A non-zero port replaces
+// the configured port of every target.
+// hasTargetPort reports whether one of p's targets has a port of its own.
+func hasTargetPort(p *config.ProxyConfig) bool {
+	if p.BackupTarget != nil && p.BackupTarget.Port != 0 {
+		return true
+	}
+	for _, t := range p.Targets {
+		if t.Port != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func newTargets(cfgs []config.TargetConfig, port int) []*proxy.Target {
+	targets := make([]*proxy.Target, 0, len(cfgs))
+	for _, t := range cfgs {
+		if port != 0 {
+			t.Port = port
+		}
+		targets = append(targets, &proxy.Target{
+			Addr:   net.JoinHostPort(t.Host, strconv.Itoa(t.Port)),
+			Weight: t.Weight,
+		})
+	}
+	return targets
+}
@@ -0,0 +1,283 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Close reasons reported in the access log.
+const (
+	CloseEOF           = "eof"            // closed by the client or the target
+	CloseLimitExceeded = "limit_exceeded" // closed by a proxy or per-client traffic limit
+	CloseDialError     = "dial_error"     // the target could not be reached
+	CloseIdleTimeout   = "idle_timeout"   // UDP session without traffic for udp_timeout
+	CloseError         = "error"          // read or write error
+	CloseKilled        = "killed"         // terminated via the API
+	CloseShutdown      = "shutdown"       // closed on shutdown
+)
+
+const accessLogBackupTime = "20060102-150405.000"
+
+// AccessLogEntry describes one finished TCP connection or UDP session.
+type AccessLogEntry struct {
+	Proxy    string    `json:"proxy"`
+	Protocol string    `json:"protocol"`
+	Client   string    `json:"client"`
+	Target   string    `json:"target"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Duration float64   `json:"duration"` // seconds
+	Upload   int64     `json:"upload"`
+	Download int64     `json:"download"`
+	Reason   string    `json:"reason"`
+}
+
+// AccessLogFilter selects entries in AccessLog.Search. Zero fields match
+// every entry.
+type AccessLogFilter struct {
+	Proxy  string
+	Client *net.IPNet
+	Since  time.Time // entries that ended at or after Since
+	Until  time.Time // entries that started at or before Until
+	Limit  int       // newest entries returned, 0 = all
+}
+
+// AccessLog writes an entry as a JSON line for every finished flow and
+// keeps the most recent entries in memory for searching. The file is
+// rotated once it reaches the maximum size or the rotation interval has
+// passed. A nil *AccessLog discards entries.
+type AccessLog struct {
+	path       string
+	maxSize    int64         // 0 = no size limit
+	interval   time.Duration // 0 = no time limit
+	maxBackups int           // 0 = keep all rotated files
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+	recent []AccessLogEntry // ring buffer of the latest entries
+	next   int              // index of the next entry in recent
+	full   bool             // recent has wrapped around
+}
+
+func NewAccessLog(path string, maxSize int64, interval time.Duration, maxBackups, recent int) (*AccessLog, error) {
+	l := &AccessLog{
+		path:       path,
+		maxSize:    maxSize,
+		interval:   interval,
+		maxBackups: maxBackups,
+		recent:     make([]AccessLogEntry, recent),
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// open opens the log file for appending. It must be called with mu held.
+func (l *AccessLog) open() error {
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file = file
+	l.size = info.Size()
+	l.opened = time.Now()
+	return nil
+}
+
+// Log records e.
+func (l *AccessLog) Log(e AccessLogEntry) {
+	if l == nil {
+		return
+	}
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("[ACCESS] Failed to encode entry: %v", err)
+		return
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.recent) > 0 {
+		l.recent[l.next] = e
+		l.next = (l.next + 1) % len(l.recent)
+		if l.next == 0 {
+			l.full = true
+		}
+	}
+
+	if l.file == nil {
+		return // Closed
+	}
+	if (l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize) ||
+		(l.interval > 0 && time.Since(l.opened) >= l.interval) {
+		if err := l.rotate(); err != nil {
+			log.Printf("[ACCESS] Failed to rotate %s: %v", l.path, err)
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		log.Printf("[ACCESS] Failed to write %s: %v", l.path, err)
+	}
+}
+
+// rotate renames the current file with a timestamp suffix, opens a new one
+// and removes the oldest rotated files beyond maxBackups. It must be called
+// with mu held.
+func (l *AccessLog) rotate() error {
+	l.file.Close()
+	backup := l.path + "." + time.Now().Format(accessLogBackupTime)
+	if err := os.Rename(l.path, backup); err != nil {
+		// Keep appending to the current file rather than losing entries
+		if openErr := l.open(); openErr != nil {
+			l.file = nil
+			return errors.Join(err, openErr)
+		}
+		return err
+	}
+	if err := l.open(); err != nil {
+		l.file = nil
+		return err
+	}
+
+	if l.maxBackups <= 0 {
+		return nil
+	}
+	backups, err := filepath.Glob(l.path + ".*")
+	if err != nil {
+		return err
+	}
+	sort.Strings(backups) // Timestamp suffixes sort oldest first
+	for len(backups) > l.maxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// Search returns the recent entries matching f, the newest first.
+func (l *AccessLog) Search(f AccessLogFilter) []AccessLogEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	n := l.next
+	if l.full {
+		n = len(l.recent)
+	}
+	result := make([]AccessLogEntry, 0)
+	for i := 0; i < n && (f.Limit <= 0 || len(result) < f.Limit); i++ {
+		e := l.recent[(l.next-1-i+len(l.recent))%len(l.recent)]
+		if f.matches(&e) {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+func (f *AccessLogFilter) matches(e *AccessLogEntry) bool {
+	if f.Proxy != "" && e.Proxy != f.Proxy {
+		return false
+	}
+	if !f.Since.IsZero() && e.End.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && e.Start.After(f.Until) {
+		return false
+	}
+	if f.Client != nil {
+		host, _, err := net.SplitHostPort(e.Client)
+		if err != nil {
+			host = e.Client
+		}
+		if ip := net.ParseIP(host); ip == nil || !f.Client.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// Close closes the log file. Later entries are only kept in memory.
+func (l *AccessLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// logFlow writes the access log entry of a finished flow.
+func (o *Options) logFlow(proxy string, f *Flow, start time.Time) {
+	if o.AccessLog == nil {
+		return
+	}
+	end := time.Now()
+	o.AccessLog.Log(AccessLogEntry{
+		Proxy:    proxy,
+		Protocol: f.Protocol,
+		Client:   f.ClientAddr,
+		Target:   f.TargetAddr,
+		Start:    start,
+		End:      end,
+		Duration: end.Sub(start).Seconds(),
+		Upload:   f.Upload(),
+		Download: f.Download(),
+		Reason:   f.CloseReason(),
+	})
+}
+
+// logDialError writes the access log entry of a flow whose target could not
+// be reached.
+func (o *Options) logDialError(proxy, protocol string, clientAddr net.Addr, target string, start time.Time) {
+	if o.AccessLog == nil {
+		return
+	}
+	end := time.Now()
+	o.AccessLog.Log(AccessLogEntry{
+		Proxy:    proxy,
+		Protocol: protocol,
+		Client:   clientAddr.String(),
+		Target:   target,
+		Start:    start,
+		End:      end,
+		Duration: end.Sub(start).Seconds(),
+		Reason:   CloseDialError,
+	})
+}
+
+// closeReason maps the error that ended one direction of a TCP connection
+// to a close reason, or "" if the connection was closed from elsewhere.
+func closeReason(err error) string {
+	switch {
+	case err == nil || err == io.EOF:
+		return CloseEOF
+	case errors.Is(err, net.ErrClosed):
+		return ""
+	default:
+		return CloseError
+	}
+}
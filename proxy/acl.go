@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+)
+
+// ACL decides which client addresses may use a proxy. A client matching a
+// deny rule is refused; if there are allow rules, a client must match one
+// of them. Rules can be replaced at runtime.
+type ACL struct {
+	mu    sync.RWMutex
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+func NewACL(allow, deny []*net.IPNet) *ACL {
+	return &ACL{allow: allow, deny: deny}
+}
+
+// Allowed reports whether ip passes the rules. A nil *ACL allows everyone.
+func (a *ACL) Allowed(ip net.IP) bool {
+	if a == nil {
+		return true
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if containsIP(a.deny, ip) {
+		return false
+	}
+	return len(a.allow) == 0 || containsIP(a.allow, ip)
+}
+
+// Rules returns the allow and deny rules in CIDR notation.
+func (a *ACL) Rules() (allow, deny []string) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return cidrStrings(a.allow), cidrStrings(a.deny)
+}
+
+// Set replaces the rules. Connections and sessions already established
+// are not affected.
+func (a *ACL) Set(allow, deny []*net.IPNet) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.allow, a.deny = allow, deny
+}
+
+func cidrStrings(nets []*net.IPNet) []string {
+	result := make([]string, 0, len(nets))
+	for _, n := range nets {
+		result = append(result, n.String())
+	}
+	return result
+}
+
+// allowed checks a client address against the global and the proxy's ACL.
+func (o *Options) allowed(addr net.Addr) bool {
+	if o.GlobalACL == nil && o.ACL == nil {
+		return true
+	}
+
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	default:
+		ip = net.ParseIP(hostOf(addr))
+	}
+	return o.GlobalACL.Allowed(ip) && o.ACL.Allowed(ip)
+}
@@ -0,0 +1,249 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/crc32"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/missuo/traffic-monitor/stats"
+)
+
+// Load balancing strategies.
+const (
+	StrategyRoundRobin = "round_robin"
+	StrategyLeastConn  = "least_conn"
+	StrategyRandom     = "random"
+	StrategyHash       = "hash" // consistent hash on the client IP
+)
+
+// hashReplicas is the number of points per unit of weight on the hash ring.
+const hashReplicas = 40
+
+// Target is one upstream address of a proxy.
+type Target struct {
+	Addr   string
+	Weight int
+
+	traffic *stats.Traffic
+	active  int64 // open connections and sessions
+	current int   // smooth weighted round robin state, guarded by Balancer.mu
+	backup  bool
+	health  targetHealth
+}
+
+func (t *Target) Active() int64 {
+	return atomic.LoadInt64(&t.active)
+}
+
+func (t *Target) acquire() {
+	atomic.AddInt64(&t.active, 1)
+}
+
+func (t *Target) release() {
+	atomic.AddInt64(&t.active, -1)
+}
+
+// Balancer picks a target for each new connection or UDP session. It is
+// shared by every listener of a proxy, so connection counts used by
+// least_conn cover TCP and UDP alike.
+type Balancer struct {
+	strategy string
+	targets  []*Target
+	backup   *Target // used while no target is healthy
+	checking bool
+	stopCh   chan struct{}
+	wg       sync.WaitGroup
+
+	mu       sync.Mutex
+	ring     []uint32
+	ringNode []*Target
+}
+
+// NewBalancer creates a balancer over targets, with an optional backup
+// target. Per-target traffic is recorded in s under each target's address.
+func NewBalancer(strategy string, targets []*Target, backup *Target, s *stats.ProxyStats) (*Balancer, error) {
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no targets")
+	}
+
+	switch strategy {
+	case "":
+		strategy = StrategyRoundRobin
+	case StrategyRoundRobin, StrategyLeastConn, StrategyRandom, StrategyHash:
+	default:
+		return nil, fmt.Errorf("unknown load balancing strategy: %s", strategy)
+	}
+
+	b := &Balancer{
+		strategy: strategy,
+		targets:  targets,
+		backup:   backup,
+		stopCh:   make(chan struct{}),
+	}
+	for _, t := range b.all() {
+		if t.Weight <= 0 {
+			t.Weight = 1
+		}
+		t.traffic = s.Targets.Get(t.Addr)
+		t.health.healthy = 1
+	}
+	if backup != nil {
+		backup.backup = true
+	}
+
+	if strategy == StrategyHash {
+		b.buildRing()
+	}
+	return b, nil
+}
+
+// Targets returns the primary targets followed by the backup target.
+func (b *Balancer) Targets() []*Target {
+	return b.all()
+}
+
+func (b *Balancer) all() []*Target {
+	if b.backup == nil {
+		return b.targets
+	}
+	return append(b.targets[:len(b.targets):len(b.targets)], b.backup)
+}
+
+// Next returns the target for a new connection from clientIP. Unhealthy
+// targets are skipped; if none is healthy the backup target is used, or
+// every target is tried as a last resort when there is no backup.
+func (b *Balancer) Next(clientIP string) *Target {
+	candidates := b.targets
+	if b.checking {
+		candidates = make([]*Target, 0, len(b.targets))
+		for _, t := range b.targets {
+			if t.Healthy() {
+				candidates = append(candidates, t)
+			}
+		}
+		if len(candidates) == 0 {
+			if b.backup != nil {
+				return b.backup
+			}
+			candidates = b.targets
+		}
+	}
+
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+
+	switch b.strategy {
+	case StrategyLeastConn:
+		return b.leastConn(candidates)
+	case StrategyRandom:
+		return b.random(candidates)
+	case StrategyHash:
+		return b.hash(clientIP, len(candidates) == len(b.targets))
+	default:
+		return b.roundRobin(candidates)
+	}
+}
+
+// roundRobin implements smooth weighted round robin.
+func (b *Balancer) roundRobin(candidates []*Target) *Target {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var best *Target
+	total := 0
+	for _, t := range candidates {
+		t.current += t.Weight
+		total += t.Weight
+		if best == nil || t.current > best.current {
+			best = t
+		}
+	}
+	best.current -= total
+	return best
+}
+
+func (b *Balancer) leastConn(candidates []*Target) *Target {
+	var best *Target
+	for _, t := range candidates {
+		// Compare active/weight without dividing
+		if best == nil || t.Active()*int64(best.Weight) < best.Active()*int64(t.Weight) {
+			best = t
+		}
+	}
+	return best
+}
+
+func (b *Balancer) random(candidates []*Target) *Target {
+	total := 0
+	for _, t := range candidates {
+		total += t.Weight
+	}
+
+	n := rand.Intn(total)
+	for _, t := range candidates {
+		if n < t.Weight {
+			return t
+		}
+		n -= t.Weight
+	}
+	return candidates[len(candidates)-1]
+}
+
+func (b *Balancer) buildRing() {
+	type point struct {
+		hash   uint32
+		target *Target
+	}
+
+	var points []point
+	for _, t := range b.targets {
+		for i := 0; i < t.Weight*hashReplicas; i++ {
+			h := crc32.ChecksumIEEE([]byte(t.Addr + "#" + strconv.Itoa(i)))
+			points = append(points, point{h, t})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].hash < points[j].hash })
+
+	b.ring = make([]uint32, len(points))
+	b.ringNode = make([]*Target, len(points))
+	for i, p := range points {
+		b.ring[i] = p.hash
+		b.ringNode[i] = p.target
+	}
+}
+
+// hash walks the ring from the client's position to the first usable
+// target, so clients of a failed target are spread over the others while
+// everyone else keeps their target.
+func (b *Balancer) hash(clientIP string, anyTarget bool) *Target {
+	h := crc32.ChecksumIEEE([]byte(clientIP))
+	start := sort.Search(len(b.ring), func(i int) bool { return b.ring[i] >= h })
+	for n := 0; n < len(b.ring); n++ {
+		t := b.ringNode[(start+n)%len(b.ring)]
+		if anyTarget || t.Healthy() {
+			return t
+		}
+	}
+	return b.ringNode[start%len(b.ring)]
+}
+
+func (b *Balancer) String() string {
+	addrs := make([]string, len(b.targets))
+	for i, t := range b.targets {
+		addrs[i] = t.Addr
+	}
+	result := addrs[0]
+	if len(addrs) > 1 {
+		result = fmt.Sprintf("[%s] (%s)", strings.Join(addrs, ", "), b.strategy)
+	}
+	if b.backup != nil {
+		result += ", backup " + b.backup.Addr
+	}
+	return result
+}
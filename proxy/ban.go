@@ -0,0 +1,290 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Events counted per client IP towards a ban.
+const (
+	BanConnections = iota // new TCP connections and UDP sessions
+	BanDialErrors         // failed dials to a target
+	BanRejections         // connections and sessions refused by a per-client limit
+	BanShortLived         // TCP connections closed within BanRules.ShortLived
+	banEvents
+)
+
+var banEventNames = [banEvents]string{"connections", "dial errors", "rejections", "short-lived connections"}
+
+const (
+	banSweepInterval = 10 * time.Second
+	maxBanTracked    = 100000 // client IPs with event counters, new ones are not tracked beyond
+)
+
+// BanRules ban a client IP for Duration once it causes more than
+// Thresholds[event] events of a kind within Window.
+type BanRules struct {
+	Thresholds [banEvents]int // 0 = event not watched
+	Window     time.Duration
+	ShortLived time.Duration // connections closed sooner count as BanShortLived
+	Duration   time.Duration
+}
+
+// Ban is a banned client IP.
+type Ban struct {
+	IP     string    `json:"ip"`
+	Reason string    `json:"reason"`
+	Since  time.Time `json:"since"`
+	Until  time.Time `json:"until"`
+}
+
+type banCounter struct {
+	start  time.Time
+	events [banEvents]int
+}
+
+// Banner bans client IPs that exceed the ban rules, shared by all proxies.
+// Bans are saved to a file and survive restarts. A nil *Banner bans nobody.
+type Banner struct {
+	rules    BanRules
+	filePath string
+	stopCh   chan struct{}
+	wg       sync.WaitGroup
+
+	mu       sync.Mutex
+	counters map[string]*banCounter
+	bans     map[string]*Ban
+	dirty    bool // bans changed since the last save
+}
+
+func NewBanner(rules BanRules, filePath string) *Banner {
+	return &Banner{
+		rules:    rules,
+		filePath: filePath,
+		stopCh:   make(chan struct{}),
+		counters: make(map[string]*banCounter),
+		bans:     make(map[string]*Ban),
+	}
+}
+
+// Banned reports whether ip is currently banned.
+func (b *Banner) Banned(ip string) bool {
+	if b == nil {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ban, exists := b.bans[ip]
+	return exists && time.Now().Before(ban.Until)
+}
+
+// Record counts an event caused by ip and bans ip once the event's
+// threshold is exceeded within the window.
+func (b *Banner) Record(ip string, event int) {
+	if b == nil || b.rules.Thresholds[event] <= 0 {
+		return
+	}
+
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ban, exists := b.bans[ip]; exists && now.Before(ban.Until) {
+		return
+	}
+
+	c := b.counters[ip]
+	if c == nil {
+		if len(b.counters) >= maxBanTracked {
+			return
+		}
+		c = &banCounter{start: now}
+		b.counters[ip] = c
+	} else if now.Sub(c.start) >= b.rules.Window {
+		*c = banCounter{start: now}
+	}
+
+	c.events[event]++
+	if c.events[event] > b.rules.Thresholds[event] {
+		delete(b.counters, ip)
+		b.ban(ip, now, b.rules.Duration, fmt.Sprintf("%d %s in %s", c.events[event], banEventNames[event], b.rules.Window))
+	}
+}
+
+// Closed records the end of a TCP connection from ip opened at start.
+func (b *Banner) Closed(ip string, start time.Time) {
+	if b != nil && time.Since(start) < b.rules.ShortLived {
+		b.Record(ip, BanShortLived)
+	}
+}
+
+// Ban bans ip for d, or for the configured ban duration if d is 0.
+func (b *Banner) Ban(ip string, d time.Duration, reason string) Ban {
+	if d <= 0 {
+		d = b.rules.Duration
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.counters, ip)
+	return b.ban(ip, time.Now(), d, reason)
+}
+
+// ban must be called with mu held.
+func (b *Banner) ban(ip string, now time.Time, d time.Duration, reason string) Ban {
+	ban := &Ban{IP: ip, Reason: reason, Since: now, Until: now.Add(d)}
+	b.bans[ip] = ban
+	b.dirty = true
+	log.Printf("[BAN] %s banned until %s: %s", ip, ban.Until.Format(time.RFC3339), reason)
+	return *ban
+}
+
+// Unban lifts the ban of ip and reports whether it was banned.
+func (b *Banner) Unban(ip string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ban, exists := b.bans[ip]
+	if !exists || !time.Now().Before(ban.Until) {
+		return false
+	}
+	delete(b.bans, ip)
+	b.dirty = true
+	log.Printf("[BAN] %s unbanned", ip)
+	return true
+}
+
+// List returns the active bans, the latest first.
+func (b *Banner) List() []Ban {
+	now := time.Now()
+	b.mu.Lock()
+	result := make([]Ban, 0, len(b.bans))
+	for _, ban := range b.bans {
+		if now.Before(ban.Until) {
+			result = append(result, *ban)
+		}
+	}
+	b.mu.Unlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Since.After(result[j].Since)
+	})
+	return result
+}
+
+// Load restores the bans saved by a previous run. Expired bans are dropped.
+func (b *Banner) Load() error {
+	data, err := os.ReadFile(b.filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var bans []Ban
+	if err := json.Unmarshal(data, &bans); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i := range bans {
+		if now.Before(bans[i].Until) {
+			b.bans[bans[i].IP] = &bans[i]
+		}
+	}
+	log.Printf("Loaded %d bans from %s", len(b.bans), b.filePath)
+	return nil
+}
+
+// Save writes the active bans to the ban file.
+func (b *Banner) Save() error {
+	data, err := json.MarshalIndent(b.List(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpFile := b.filePath + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, b.filePath)
+}
+
+// Start periodically drops expired bans and stale event counters, and saves
+// the bans when they changed.
+func (b *Banner) Start() {
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		ticker := time.NewTicker(banSweepInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := b.saveChanges(); err != nil {
+					log.Printf("Failed to save bans: %v", err)
+				}
+			case <-b.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the sweeper and saves the bans if they changed.
+func (b *Banner) Stop() {
+	close(b.stopCh)
+	b.wg.Wait()
+
+	if err := b.saveChanges(); err != nil {
+		log.Printf("Failed to save bans on shutdown: %v", err)
+	}
+}
+
+func (b *Banner) saveChanges() error {
+	if !b.sweep() {
+		return nil
+	}
+	if err := b.Save(); err != nil {
+		b.mu.Lock()
+		b.dirty = true // Retry with the next sweep
+		b.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// sweep drops expired bans and counters and reports whether the bans need
+// to be saved.
+func (b *Banner) sweep() bool {
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ip, ban := range b.bans {
+		if !now.Before(ban.Until) {
+			delete(b.bans, ip)
+			b.dirty = true
+		}
+	}
+	for ip, c := range b.counters {
+		if now.Sub(c.start) >= b.rules.Window {
+			delete(b.counters, ip)
+		}
+	}
+
+	dirty := b.dirty
+	b.dirty = false
+	return dirty
+}
@@ -0,0 +1,31 @@
+package proxy
+
+import "net"
+
+// ClientPrefix groups client addresses for per-client accounting: IPv4
+// clients by their first IPv4 bits and IPv6 clients by their first IPv6
+// bits. Full-length prefixes (32 and 128) count every address on its own.
+type ClientPrefix struct {
+	IPv4 int
+	IPv6 int
+}
+
+// Key returns the key of addr's per-client counters: its IP address, or
+// the prefix containing it in CIDR notation.
+func (c *ClientPrefix) Key(addr net.Addr) string {
+	host := hostOf(addr)
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+
+	ones, bits := c.IPv6, 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, ones, bits = ip4, c.IPv4, 32
+	}
+	if ones >= bits {
+		return ip.String()
+	}
+	mask := net.CIDRMask(ones, bits)
+	return (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String()
+}
@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+var (
+	errMaxConnections      = errors.New("max_connections reached")
+	errMaxConnectionsPerIP = errors.New("max_connections_per_ip reached")
+)
+
+// ConnLimiter caps the number of concurrent connections of a proxy, in
+// total and per client IP. A nil *ConnLimiter admits every connection.
+type ConnLimiter struct {
+	max      int
+	maxPerIP int
+
+	mu    sync.Mutex
+	total int
+	perIP map[string]int
+}
+
+// NewConnLimiter returns a limiter for max connections in total and
+// maxPerIP connections per client IP, where 0 means unlimited. It returns
+// nil if both are unlimited.
+func NewConnLimiter(max, maxPerIP int) *ConnLimiter {
+	if max <= 0 && maxPerIP <= 0 {
+		return nil
+	}
+	return &ConnLimiter{
+		max:      max,
+		maxPerIP: maxPerIP,
+		perIP:    make(map[string]int),
+	}
+}
+
+// Acquire reserves a slot for a connection from ip. Every successful call
+// must be paired with Release.
+func (l *ConnLimiter) Acquire(ip string) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.max > 0 && l.total >= l.max {
+		return errMaxConnections
+	}
+	if l.maxPerIP > 0 && l.perIP[ip] >= l.maxPerIP {
+		return errMaxConnectionsPerIP
+	}
+	l.total++
+	l.perIP[ip]++
+	return nil
+}
+
+func (l *ConnLimiter) Release(ip string) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.total--
+	if l.perIP[ip] <= 1 {
+		delete(l.perIP, ip)
+	} else {
+		l.perIP[ip]--
+	}
+}
+
+// hostOf returns the IP of addr without the port.
+func hostOf(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP.String()
+	case *net.UDPAddr:
+		return a.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,317 @@
+package proxy
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/missuo/traffic-monitor/stats"
+)
+
+// Flow is an active TCP connection or UDP client session.
+type Flow struct {
+	ID         string
+	Protocol   string
+	ClientAddr string
+	TargetAddr string
+	StartTime  time.Time
+
+	lastActive      int64 // unix nanoseconds
+	upload          int64
+	download        int64
+	uploadPackets   int64 // datagrams, UDP sessions only
+	downloadPackets int64
+	closeFn         func()
+	counters        []counter // breakdown counters fed along with the flow
+
+	clientKey string               // key of client in the per-client stats
+	client    *stats.ClientTraffic // nil without per-client stats
+
+	reasonOnce sync.Once
+	reason     string // why the flow ended, one of the Close constants
+}
+
+// counter is a breakdown counter such as *stats.Traffic.
+type counter interface {
+	AddUpload(n int64)
+	AddDownload(n int64)
+}
+
+// track adds counters that receive every byte of the flow. It must be
+// called before any traffic is recorded.
+func (f *Flow) track(c counter) {
+	f.counters = append(f.counters, c)
+}
+
+// trackClient feeds the flow into the counters of its client, against
+// which the per-client quota is checked.
+func (f *Flow) trackClient(key string, c *stats.ClientTraffic) {
+	f.clientKey = key
+	f.client = c
+	f.track(c)
+}
+
+func (f *Flow) AddUpload(n int64) {
+	atomic.AddInt64(&f.upload, n)
+	atomic.StoreInt64(&f.lastActive, time.Now().UnixNano())
+	for _, c := range f.counters {
+		c.AddUpload(n)
+	}
+}
+
+func (f *Flow) AddDownload(n int64) {
+	atomic.AddInt64(&f.download, n)
+	atomic.StoreInt64(&f.lastActive, time.Now().UnixNano())
+	for _, c := range f.counters {
+		c.AddDownload(n)
+	}
+}
+
+// AddUploadPackets and AddDownloadPackets count the datagrams of a UDP
+// session. Their bytes are added separately with AddUpload and AddDownload.
+func (f *Flow) AddUploadPackets(n int64) {
+	atomic.AddInt64(&f.uploadPackets, n)
+}
+
+func (f *Flow) AddDownloadPackets(n int64) {
+	atomic.AddInt64(&f.downloadPackets, n)
+}
+
+func (f *Flow) Upload() int64 {
+	return atomic.LoadInt64(&f.upload)
+}
+
+func (f *Flow) Download() int64 {
+	return atomic.LoadInt64(&f.download)
+}
+
+func (f *Flow) UploadPackets() int64 {
+	return atomic.LoadInt64(&f.uploadPackets)
+}
+
+func (f *Flow) DownloadPackets() int64 {
+	return atomic.LoadInt64(&f.downloadPackets)
+}
+
+// Close terminates the flow.
+func (f *Flow) Close() {
+	f.closeFn()
+}
+
+// setCloseReason records why the flow ends. The first reason set wins; ""
+// is ignored.
+func (f *Flow) setCloseReason(reason string) {
+	if reason == "" {
+		return
+	}
+	f.reasonOnce.Do(func() {
+		f.reason = reason
+	})
+}
+
+// CloseReason returns why the flow ended, CloseEOF if no other reason was
+// recorded.
+func (f *Flow) CloseReason() string {
+	f.setCloseReason(CloseEOF)
+	return f.reason
+}
+
+func (f *Flow) LastActive() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&f.lastActive))
+}
+
+// ConnTable tracks the active flows of one proxy. It is shared by the TCP
+// and UDP halves of a proxy, so IDs are unique per proxy name.
+type ConnTable struct {
+	mu     sync.RWMutex
+	flows  map[string]*Flow
+	nextID uint64
+}
+
+func NewConnTable() *ConnTable {
+	return &ConnTable{
+		flows: make(map[string]*Flow),
+	}
+}
+
+// Add registers a new flow. closeFn is called by Kill to terminate it.
+func (t *ConnTable) Add(protocol, clientAddr, targetAddr string, closeFn func()) *Flow {
+	now := time.Now()
+	f := &Flow{
+		ID:         strconv.FormatUint(atomic.AddUint64(&t.nextID, 1), 10),
+		Protocol:   protocol,
+		ClientAddr: clientAddr,
+		TargetAddr: targetAddr,
+		StartTime:  now,
+		lastActive: now.UnixNano(),
+		closeFn:    closeFn,
+	}
+
+	t.mu.Lock()
+	t.flows[f.ID] = f
+	t.mu.Unlock()
+	return f
+}
+
+func (t *ConnTable) Remove(f *Flow) {
+	t.mu.Lock()
+	delete(t.flows, f.ID)
+	t.mu.Unlock()
+}
+
+// List returns the active flows ordered by start time.
+func (t *ConnTable) List() []*Flow {
+	t.mu.RLock()
+	result := make([]*Flow, 0, len(t.flows))
+	for _, f := range t.flows {
+		result = append(result, f)
+	}
+	t.mu.RUnlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].StartTime.Before(result[j].StartTime)
+	})
+	return result
+}
+
+// Kill terminates the flow with the given ID. It returns false if no such
+// flow is active.
+func (t *ConnTable) Kill(id string) bool {
+	t.mu.RLock()
+	f, exists := t.flows[id]
+	t.mu.RUnlock()
+
+	if !exists {
+		return false
+	}
+	f.setCloseReason(CloseKilled)
+	f.Close()
+	return true
+}
+
+// Registry maps proxy names to their connection tables, balancers and
+// access control lists, and holds the bans and the access log shared by
+// all proxies.
+type Registry struct {
+	mu        sync.RWMutex
+	tables    map[string]*ConnTable
+	balancers map[string][]*Balancer
+	acls      map[string]*ACL
+	globalACL *ACL
+	bans      *Banner
+	accessLog *AccessLog
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		tables:    make(map[string]*ConnTable),
+		balancers: make(map[string][]*Balancer),
+		acls:      make(map[string]*ACL),
+	}
+}
+
+// SetACL sets the access control list of a proxy.
+func (r *Registry) SetACL(name string, a *ACL) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.acls[name] = a
+}
+
+// ACL returns the access control list of a proxy, or nil if it is unknown.
+func (r *Registry) ACL(name string) *ACL {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.acls[name]
+}
+
+// SetGlobalACL sets the access control list applied to all proxies.
+func (r *Registry) SetGlobalACL(a *ACL) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.globalACL = a
+}
+
+// GlobalACL returns the access control list applied to all proxies.
+func (r *Registry) GlobalACL() *ACL {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.globalACL
+}
+
+// SetBans sets the ban list shared by all proxies.
+func (r *Registry) SetBans(b *Banner) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.bans = b
+}
+
+// Bans returns the ban list shared by all proxies.
+func (r *Registry) Bans() *Banner {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.bans
+}
+
+// SetAccessLog sets the access log shared by all proxies.
+func (r *Registry) SetAccessLog(l *AccessLog) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.accessLog = l
+}
+
+// AccessLog returns the access log shared by all proxies, or nil if it is
+// disabled.
+func (r *Registry) AccessLog() *AccessLog {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.accessLog
+}
+
+// AddBalancer adds a balancer of a proxy. A proxy listening on several
+// ports has one balancer per port when the ports map to different targets.
+func (r *Registry) AddBalancer(name string, b *Balancer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.balancers[name] = append(r.balancers[name], b)
+}
+
+// Balancer returns the balancers of a proxy, or nil if it is unknown.
+func (r *Registry) Balancer(name string) []*Balancer {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.balancers[name]
+}
+
+// Balancers returns the balancers of all proxies by name.
+func (r *Registry) Balancers() map[string][]*Balancer {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	result := make(map[string][]*Balancer, len(r.balancers))
+	for k, v := range r.balancers {
+		result[k] = v
+	}
+	return result
+}
+
+// Table returns the connection table of a proxy, creating it if needed.
+func (r *Registry) Table(name string) *ConnTable {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if t, exists := r.tables[name]; exists {
+		return t
+	}
+	t := NewConnTable()
+	r.tables[name] = t
+	return t
+}
+
+// Get returns the connection table of a proxy, or nil if it is unknown.
+func (r *Registry) Get(name string) *ConnTable {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.tables[name]
+}
@@ -0,0 +1,191 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Dial policies select the address family used to reach targets whose host
+// name resolves to both IPv4 and IPv6 addresses.
+const (
+	DialPreferIPv4 = "prefer_ipv4"
+	DialPreferIPv6 = "prefer_ipv6"
+	DialIPv4Only   = "ipv4_only"
+	DialIPv6Only   = "ipv6_only"
+)
+
+// Dialer connects to targets. The zero value dials like net.Dial.
+type Dialer struct {
+	Policy  string        // one of the Dial constants, "" = resolver order
+	Timeout time.Duration // per connection attempt, 0 = no timeout
+
+	// SourceAddr is the local address of outgoing connections, nil = chosen
+	// by the kernel. Only targets of the same address family are dialed.
+	SourceAddr net.IP
+	// Interface binds outgoing connections to a network device
+	// (SO_BINDTODEVICE) and Mark sets their firewall mark (SO_MARK). Both
+	// are Linux only.
+	Interface string
+	Mark      int
+}
+
+// Dial connects to addr on network "tcp" or "udp". The addresses of addr's
+// host are tried in policy order until one succeeds.
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext is like Dial but gives up once ctx is done.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := d.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := d.netDialer(network)
+	var firstErr error
+	for _, ip := range ips {
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+// ResolveUDPAddr resolves addr to the first UDP address in policy order.
+func (d *Dialer) ResolveUDPAddr(addr string) (*net.UDPAddr, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := d.resolve(context.Background(), host)
+	if err != nil {
+		return nil, err
+	}
+	return net.ResolveUDPAddr("udp", net.JoinHostPort(ips[0].String(), port))
+}
+
+// DialUDP connects a UDP socket to an already resolved target address.
+func (d *Dialer) DialUDP(raddr *net.UDPAddr) (*net.UDPConn, error) {
+	conn, err := d.netDialer("udp").Dial("udp", raddr.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+func (d *Dialer) netDialer(network string) *net.Dialer {
+	dialer := &net.Dialer{Timeout: d.Timeout}
+	if d.SourceAddr != nil {
+		if strings.HasPrefix(network, "udp") {
+			dialer.LocalAddr = &net.UDPAddr{IP: d.SourceAddr}
+		} else {
+			dialer.LocalAddr = &net.TCPAddr{IP: d.SourceAddr}
+		}
+	}
+	if d.Interface != "" || d.Mark != 0 {
+		dialer.Control = d.control
+	}
+	return dialer
+}
+
+// resolve returns the addresses of host allowed by the policy, preferred
+// family first.
+func (d *Dialer) resolve(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	switch d.Policy {
+	case DialIPv4Only, DialIPv6Only:
+		wantIPv4 := d.Policy == DialIPv4Only
+		filtered := ips[:0]
+		for _, ip := range ips {
+			if (ip.IP.To4() != nil) == wantIPv4 {
+				filtered = append(filtered, ip)
+			}
+		}
+		ips = filtered
+	case DialPreferIPv4, DialPreferIPv6:
+		preferIPv4 := d.Policy == DialPreferIPv4
+		sort.SliceStable(ips, func(i, j int) bool {
+			return (ips[i].IP.To4() != nil) == preferIPv4 && (ips[j].IP.To4() != nil) != preferIPv4
+		})
+	}
+
+	if d.SourceAddr != nil {
+		sourceIPv4 := d.SourceAddr.To4() != nil
+		filtered := ips[:0]
+		for _, ip := range ips {
+			if (ip.IP.To4() != nil) == sourceIPv4 {
+				filtered = append(filtered, ip)
+			}
+		}
+		ips = filtered
+	}
+
+	if len(ips) == 0 {
+		if d.SourceAddr != nil {
+			return nil, fmt.Errorf("no address for %s allowed by dial policy %s and source address %s", host, d.Policy, d.SourceAddr)
+		}
+		return nil, fmt.Errorf("no address for %s allowed by dial policy %s", host, d.Policy)
+	}
+	return ips, nil
+}
+
+// ListenHosts resolves a listen address to the hosts to bind. It accepts an
+// IP address, a network interface name (all addresses of the interface), or
+// a host name; "" binds all addresses.
+func ListenHosts(addr string) ([]string, error) {
+	addr = strings.Trim(addr, "[]")
+	if addr == "" || net.ParseIP(addr) != nil {
+		return []string{addr}, nil
+	}
+
+	iface, err := net.InterfaceByName(addr)
+	if err != nil {
+		return []string{addr}, nil // Host name, resolved by net.Listen
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var hosts []string
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		host := ipNet.IP.String()
+		if ipNet.IP.IsLinkLocalUnicast() && ipNet.IP.To4() == nil {
+			host += "%" + iface.Name
+		}
+		hosts = append(hosts, host)
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("interface %s has no addresses", iface.Name)
+	}
+	return hosts, nil
+}
+
+// addressFamily returns "ipv4" or "ipv6" for a client address. IPv4 clients
+// of dual-stack listeners count as IPv4.
+func addressFamily(addr net.Addr) string {
+	if ip := net.ParseIP(hostOf(addr)); ip != nil && ip.To4() == nil {
+		return "ipv6"
+	}
+	return "ipv4"
+}
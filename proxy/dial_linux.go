@@ -0,0 +1,30 @@
+//go:build linux
+
+package proxy
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// control applies the socket options of d before the socket connects.
+func (d *Dialer) control(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		if d.Interface != "" {
+			if err := syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, d.Interface); err != nil {
+				sockErr = fmt.Errorf("failed to bind to interface %s: %w", d.Interface, err)
+				return
+			}
+		}
+		if d.Mark != 0 {
+			if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, d.Mark); err != nil {
+				sockErr = fmt.Errorf("failed to set fwmark %d: %w", d.Mark, err)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package proxy
+
+import (
+	"errors"
+	"syscall"
+)
+
+func (d *Dialer) control(network, address string, c syscall.RawConn) error {
+	return errors.New("bind_interface and fwmark are only supported on Linux")
+}
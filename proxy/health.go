@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HealthCheck configures active probing of a balancer's targets.
+type HealthCheck struct {
+	Network  string // "tcp" probes by connecting, "udp" by request/response
+	Interval time.Duration
+	Timeout  time.Duration
+	Rise     int    // consecutive successes to mark a target healthy
+	Fall     int    // consecutive failures to mark a target unhealthy
+	Send     []byte // UDP probe payload
+	Expect   []byte // substring expected in the UDP reply, empty = any reply
+	Dialer   Dialer // address family policy of the proxy
+}
+
+type targetHealth struct {
+	healthy int32 // accessed atomically
+
+	mu        sync.Mutex
+	successes int
+	failures  int
+	lastCheck time.Time
+	lastError string
+}
+
+func (t *Target) Healthy() bool {
+	return atomic.LoadInt32(&t.health.healthy) == 1
+}
+
+// Health returns the result of the last probe. lastCheck is zero while
+// health checks are disabled.
+func (t *Target) Health() (healthy bool, lastCheck time.Time, lastError string) {
+	t.health.mu.Lock()
+	defer t.health.mu.Unlock()
+	return t.Healthy(), t.health.lastCheck, t.health.lastError
+}
+
+func (t *Target) IsBackup() bool {
+	return t.backup
+}
+
+// HealthChecked reports whether targets are actively probed.
+func (b *Balancer) HealthChecked() bool {
+	return b.checking
+}
+
+// StartHealthChecks probes every target at the configured interval. It must
+// be called before the balancer is used.
+func (b *Balancer) StartHealthChecks(name string, hc HealthCheck) {
+	b.checking = true
+
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		ticker := time.NewTicker(hc.Interval)
+		defer ticker.Stop()
+
+		for {
+			b.checkAll(name, &hc)
+			select {
+			case <-ticker.C:
+			case <-b.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops health checking.
+func (b *Balancer) Stop() {
+	close(b.stopCh)
+	b.wg.Wait()
+}
+
+func (b *Balancer) checkAll(name string, hc *HealthCheck) {
+	var wg sync.WaitGroup
+	for _, t := range b.all() {
+		wg.Add(1)
+		go func(t *Target) {
+			defer wg.Done()
+			t.recordProbe(name, hc, hc.probe(t.Addr))
+		}(t)
+	}
+	wg.Wait()
+}
+
+func (t *Target) recordProbe(name string, hc *HealthCheck, err error) {
+	t.health.mu.Lock()
+	defer t.health.mu.Unlock()
+
+	t.health.lastCheck = time.Now()
+	if err == nil {
+		t.health.lastError = ""
+		t.health.failures = 0
+		t.health.successes++
+		if !t.Healthy() && t.health.successes >= hc.Rise {
+			atomic.StoreInt32(&t.health.healthy, 1)
+			log.Printf("[%s] target %s is UP", name, t.Addr)
+		}
+		return
+	}
+
+	t.health.lastError = err.Error()
+	t.health.successes = 0
+	t.health.failures++
+	if t.Healthy() && t.health.failures >= hc.Fall {
+		atomic.StoreInt32(&t.health.healthy, 0)
+		log.Printf("[%s] target %s is DOWN: %v", name, t.Addr, err)
+	}
+}
+
+func (hc *HealthCheck) probe(addr string) error {
+	dialer := hc.Dialer
+	dialer.Timeout = hc.Timeout
+	conn, err := dialer.Dial(hc.Network, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if hc.Network != "udp" {
+		return nil
+	}
+
+	conn.SetDeadline(time.Now().Add(hc.Timeout))
+	if _, err := conn.Write(hc.Send); err != nil {
+		return err
+	}
+	buf := make([]byte, defaultUDPBufferSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return err
+	}
+	if len(hc.Expect) > 0 && !bytes.Contains(buf[:n], hc.Expect) {
+		return errors.New("unexpected UDP response")
+	}
+	return nil
+}
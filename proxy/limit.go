@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/missuo/traffic-monitor/stats"
+)
+
+// checkLimit reports whether s is over one of its traffic limits and
+// whether its on_exceed policy requires the traffic to be blocked.
+func checkLimit(name string, s *stats.ProxyStats) (exceeded, blocked bool) {
+	limit := s.ExceededLimit()
+	if limit == "" {
+		return false, false
+	}
+
+	policy := s.OnExceed
+	if policy == "" {
+		policy = stats.PolicyBlock
+	}
+	if s.FirstExceeded() {
+		log.Printf("[%s] %s limit exceeded, applying %s policy", name, limit, policy)
+	}
+	return true, policy == stats.PolicyBlock
+}
+
+// limiter returns the rate limiter for one direction of traffic. Once the
+// proxy is over its limit, the throttle limiter takes over if configured.
+func (o *Options) limiter(upload, exceeded bool) *RateLimiter {
+	if exceeded && (o.ThrottleUpload != nil || o.ThrottleDownload != nil) {
+		if upload {
+			return o.ThrottleUpload
+		}
+		return o.ThrottleDownload
+	}
+	if upload {
+		return o.UploadLimiter
+	}
+	return o.DownloadLimiter
+}
+
+// clientLimit checks the quota of one client of s, whose key is used in
+// log messages and to pick its throttle limiter for one direction of
+// traffic. Only that client is blocked or throttled; a nil client has no
+// quota.
+func (o *Options) clientLimit(name string, s *stats.ProxyStats, key string, client *stats.ClientTraffic, upload bool) (limiter *RateLimiter, blocked bool) {
+	if client == nil {
+		return nil, false
+	}
+	limit := s.ClientExceededLimit(client)
+	if limit == "" {
+		o.ClientThrottle.Release(key) // Back under quota, e.g. after the monthly reset
+		return nil, false
+	}
+
+	policy := s.ClientOnExceed
+	if policy == "" {
+		policy = stats.PolicyBlock
+	}
+	if client.FirstExceeded() {
+		log.Printf("[%s] client %s: %s limit exceeded, applying %s policy", name, key, limit, policy)
+	}
+	switch policy {
+	case stats.PolicyThrottle:
+		return o.ClientThrottle.Limiter(key, upload), false
+	case stats.PolicyAlertOnly:
+		return nil, false
+	}
+	return nil, true
+}
+
+// clientThrottleIdle is how long a throttled client's limiters are kept
+// without being used, so clients that went away, e.g. evicted from the
+// client table, do not pile up.
+const clientThrottleIdle = 10 * time.Minute
+
+type clientLimiters struct {
+	limiters [2]*RateLimiter // upload, download
+	lastUsed time.Time
+}
+
+// ClientThrottle hands out rate limiters per client over its quota, one for
+// each direction, so each throttled client is slowed down on its own. A nil
+// *ClientThrottle never throttles.
+type ClientThrottle struct {
+	rate, burst int64
+	count       int32 // len(limiters), read without mu
+
+	mu        sync.Mutex
+	limiters  map[string]*clientLimiters
+	lastSweep time.Time
+}
+
+// NewClientThrottle returns a ClientThrottle allowing each client rate
+// bytes per second with bursts of up to burst bytes. It returns nil if rate
+// is not positive.
+func NewClientThrottle(rate, burst int64) *ClientThrottle {
+	if rate <= 0 {
+		return nil
+	}
+	return &ClientThrottle{
+		rate:     rate,
+		burst:    burst,
+		limiters: make(map[string]*clientLimiters),
+	}
+}
+
+// Limiter returns the rate limiter for one direction of traffic of the
+// client with the given key.
+func (t *ClientThrottle) Limiter(key string, upload bool) *RateLimiter {
+	if t == nil {
+		return nil
+	}
+
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	l, exists := t.limiters[key]
+	if !exists {
+		if now.Sub(t.lastSweep) >= clientThrottleIdle {
+			t.sweep(now)
+		}
+		l = &clientLimiters{limiters: [2]*RateLimiter{NewRateLimiter(t.rate, t.burst), NewRateLimiter(t.rate, t.burst)}}
+		t.limiters[key] = l
+		atomic.StoreInt32(&t.count, int32(len(t.limiters)))
+	}
+	l.lastUsed = now
+	if upload {
+		return l.limiters[0]
+	}
+	return l.limiters[1]
+}
+
+// Release drops the limiters of the client with the given key once it is no
+// longer throttled.
+func (t *ClientThrottle) Release(key string) {
+	if t == nil || atomic.LoadInt32(&t.count) == 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.limiters, key)
+	atomic.StoreInt32(&t.count, int32(len(t.limiters)))
+}
+
+// sweep drops the limiters not used for clientThrottleIdle. It must be
+// called with mu held.
+func (t *ClientThrottle) sweep(now time.Time) {
+	for key, l := range t.limiters {
+		if now.Sub(l.lastUsed) >= clientThrottleIdle {
+			delete(t.limiters, key)
+		}
+	}
+	t.lastSweep = now
+}
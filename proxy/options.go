@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+)
+
+// Options holds per-proxy settings shared by the TCP and UDP proxies.
+type Options struct {
+	// LimitCheck is the number of bytes an active connection may forward
+	// between two checks of the traffic limits. 0 checks after every read.
+	LimitCheck int64
+
+	// UploadLimiter and DownloadLimiter shape client->target and
+	// target->client traffic. They are shared by every connection of the
+	// proxy, including the TCP and UDP halves of a "both" proxy.
+	UploadLimiter   *RateLimiter
+	DownloadLimiter *RateLimiter
+
+	// ThrottleUpload and ThrottleDownload replace the limiters above once a
+	// traffic limit is exceeded under the throttle policy.
+	ThrottleUpload   *RateLimiter
+	ThrottleDownload *RateLimiter
+
+	// ConnLimiter caps concurrent TCP connections, in total and per client
+	// IP. MaxUDPSessions caps concurrent UDP client sessions, 0 = unlimited.
+	ConnLimiter    *ConnLimiter
+	MaxUDPSessions int
+
+	// UDPTimeout closes UDP sessions without traffic for that long.
+	// UDPCleanupInterval is the minimum time between two idle checks of a
+	// session, so an idle session is closed up to that much later.
+	// UDPBufferSize is the largest datagram forwarded; longer ones are
+	// truncated. Zero values use the defaults (60s, 1s, 64KB).
+	UDPTimeout         time.Duration
+	UDPCleanupInterval time.Duration
+	UDPBufferSize      int
+
+	// Conns tracks the active flows of the proxy.
+	Conns *ConnTable
+
+	// ClientStats breaks traffic down by client in the Clients map of the
+	// proxy's (or route's) stats, grouped by these prefixes. nil = disabled.
+	// The per-client quota of the stats is enforced on the same clients;
+	// ClientThrottle slows down clients over it under the throttle policy.
+	ClientStats    *ClientPrefix
+	ClientThrottle *ClientThrottle
+
+	// SendProxyProtocol is the PROXY protocol version announced to the
+	// target (ProxyProtocolV1 or ProxyProtocolV2), 0 = disabled. UDP
+	// sessions only support v2, sent with their first datagram.
+	SendProxyProtocol int
+
+	// AcceptProxyProtocol makes the TCP listener read a PROXY v1/v2 header
+	// from upstreams in ProxyProtocolTrusted (none if empty) and use the
+	// client address it announces. Other peers are served as direct clients.
+	AcceptProxyProtocol  bool
+	ProxyProtocolTrusted []*net.IPNet
+
+	// GlobalACL and ACL restrict the client addresses served by the proxy;
+	// a client must pass both. nil = no restriction.
+	GlobalACL *ACL
+	ACL       *ACL
+	// Bans refuses banned client IPs and bans abusive ones, nil = disabled.
+	Bans *Banner
+	// AccessLog records every finished connection and UDP session, nil =
+	// disabled.
+	AccessLog *AccessLog
+
+	// TLS terminates TLS on the TCP listener, nil = plain TCP.
+	TLS *tls.Config
+
+	// TargetTLS wraps connections to the target in TLS, nil = plain TCP.
+	TargetTLS *tls.Config
+
+	// Routes pick targets, stats and quota per TCP connection by the SNI
+	// hostname of the TLS ClientHello. Connections that match no route use
+	// the proxy's own targets.
+	Routes []*Route
+
+	// Sniff classifies each TCP connection by its first bytes (see the
+	// Protocol constants), sends it to SniffTargets[protocol] if present
+	// and breaks its traffic down by protocol. SniffTimeout bounds the wait
+	// for the client's first bytes.
+	Sniff        bool
+	SniffTargets map[string]*Balancer
+	SniffTimeout time.Duration
+
+	// Dialer connects to targets and applies the proxy's dial policy.
+	Dialer Dialer
+
+	// DisableZeroCopy forces plain TCP connections through a userspace
+	// buffer instead of splice(2) on Linux.
+	DisableZeroCopy bool
+
+	// ShutdownTimeout is how long Stop waits for active connections and
+	// UDP sessions to finish before closing them.
+	ShutdownTimeout time.Duration
+}
+
+func (o *Options) trustedUpstream(addr net.Addr) bool {
+	ip, _, _ := splitAddr(addr)
+	return ip != nil && containsIP(o.ProxyProtocolTrusted, ip)
+}
+
+// waitTimeout waits for wg and reports whether it finished within d.
+func waitTimeout(wg *sync.WaitGroup, d time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
@@ -0,0 +1,45 @@
+package proxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParsePorts parses a comma-separated list of ports and inclusive port
+// ranges, e.g. "27000-27050" or "80,443,8000-8010". Ports are returned in
+// the order given.
+func ParsePorts(s string) ([]int, error) {
+	var ports []int
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		first, last, isRange := strings.Cut(part, "-")
+
+		from, err := parsePort(first)
+		if err != nil {
+			return nil, err
+		}
+		to := from
+		if isRange {
+			if to, err = parsePort(last); err != nil {
+				return nil, err
+			}
+			if to < from {
+				return nil, fmt.Errorf("invalid port range: %s", part)
+			}
+		}
+
+		for port := from; port <= to; port++ {
+			ports = append(ports, port)
+		}
+	}
+	return ports, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port: %s", s)
+	}
+	return port, nil
+}
@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParsePorts(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []int
+		wantErr bool
+	}{
+		{in: "80", want: []int{80}},
+		{in: "80,443", want: []int{80, 443}},
+		{in: "443, 80", want: []int{443, 80}},
+		{in: "8000-8003", want: []int{8000, 8001, 8002, 8003}},
+		{in: "80,8000-8001,443", want: []int{80, 8000, 8001, 443}},
+		{in: "7-7", want: []int{7}},
+		{in: "1,65535", want: []int{1, 65535}},
+		{in: "", wantErr: true},
+		{in: "0", wantErr: true},
+		{in: "65536", wantErr: true},
+		{in: "80,", wantErr: true},
+		{in: "8003-8000", wantErr: true},
+		{in: "8000-", wantErr: true},
+		{in: "http", wantErr: true},
+		{in: "-80", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParsePorts(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParsePorts(%q) = %v, want error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || !slices.Equal(got, tt.want) {
+			t.Errorf("ParsePorts(%q) = %v, %v, want %v", tt.in, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PROXY protocol versions for Options.SendProxyProtocol.
+const (
+	ProxyProtocolV1 = 1
+	ProxyProtocolV2 = 2
+)
+
+const proxyHeaderTimeout = 5 * time.Second
+
+var proxyV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+// proxyHeader builds a PROXY protocol header announcing a connection from
+// src to dst. Version 1 only describes TCP connections.
+func proxyHeader(version int, src, dst net.Addr) []byte {
+	srcIP, srcPort, udp := splitAddr(src)
+	dstIP, dstPort, _ := splitAddr(dst)
+
+	if srcIP != nil && dstIP != nil {
+		if dstIP.IsUnspecified() && srcIP.To4() != nil {
+			dstIP = net.IPv4zero
+		}
+		// Both addresses must belong to the same family
+		if srcIP.To4() == nil || dstIP.To4() == nil {
+			srcIP, dstIP = srcIP.To16(), dstIP.To16()
+		} else {
+			srcIP, dstIP = srcIP.To4(), dstIP.To4()
+		}
+	}
+
+	if version == ProxyProtocolV1 {
+		return proxyHeaderV1(srcIP, dstIP, srcPort, dstPort)
+	}
+	return proxyHeaderV2(srcIP, dstIP, srcPort, dstPort, udp)
+}
+
+func proxyHeaderV1(srcIP, dstIP net.IP, srcPort, dstPort int) []byte {
+	if srcIP == nil || dstIP == nil {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	family := "TCP4"
+	if len(srcIP) == net.IPv6len {
+		family = "TCP6"
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, srcIP, dstIP, srcPort, dstPort))
+}
+
+func proxyHeaderV2(srcIP, dstIP net.IP, srcPort, dstPort int, udp bool) []byte {
+	header := make([]byte, 16, 16+36)
+	copy(header, proxyV2Signature)
+
+	if srcIP == nil || dstIP == nil {
+		header[12] = 0x20 // version 2, LOCAL
+		return header
+	}
+
+	header[12] = 0x21 // version 2, PROXY
+	family := byte(0x10)
+	if len(srcIP) == net.IPv6len {
+		family = 0x20
+	}
+	transport := byte(0x01)
+	if udp {
+		transport = 0x02
+	}
+	header[13] = family | transport
+
+	header = append(header, srcIP...)
+	header = append(header, dstIP...)
+	header = binary.BigEndian.AppendUint16(header, uint16(srcPort))
+	header = binary.BigEndian.AppendUint16(header, uint16(dstPort))
+	binary.BigEndian.PutUint16(header[14:16], uint16(len(header)-16))
+	return header
+}
+
+func splitAddr(addr net.Addr) (ip net.IP, port int, udp bool) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP, a.Port, false
+	case *net.UDPAddr:
+		return a.IP, a.Port, true
+	}
+	return nil, 0, false
+}
+
+// readProxyHeader consumes a PROXY protocol v1 or v2 header from conn and
+// returns the source and destination it announces. Nothing beyond the header
+// is read, so the connection can be forwarded as is afterwards. For LOCAL
+// and UNKNOWN headers the addresses of conn itself are returned.
+func readProxyHeader(conn net.Conn) (src, dst net.Addr, err error) {
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	src, dst = conn.RemoteAddr(), conn.LocalAddr()
+
+	// 12 bytes hold the v2 signature and are shorter than any v1 header
+	prefix := make([]byte, 12)
+	if _, err := io.ReadFull(conn, prefix); err != nil {
+		return nil, nil, err
+	}
+
+	if bytes.Equal(prefix, proxyV2Signature) {
+		return readProxyHeaderV2(conn, src, dst)
+	}
+	if bytes.HasPrefix(prefix, []byte("PROXY ")) {
+		return readProxyHeaderV1(conn, prefix, src, dst)
+	}
+	return nil, nil, errors.New("missing PROXY protocol header")
+}
+
+func readProxyHeaderV1(conn net.Conn, line []byte, src, dst net.Addr) (net.Addr, net.Addr, error) {
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= 107 {
+			return nil, nil, errors.New("PROXY v1 header too long")
+		}
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b[0])
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return src, dst, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("invalid PROXY v1 header: %q", strings.TrimSpace(string(line)))
+	}
+
+	srcIP, dstIP := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, err1 := strconv.Atoi(fields[4])
+	dstPort, err2 := strconv.Atoi(fields[5])
+	if srcIP == nil || dstIP == nil || err1 != nil || err2 != nil {
+		return nil, nil, fmt.Errorf("invalid PROXY v1 header: %q", strings.TrimSpace(string(line)))
+	}
+	return &net.TCPAddr{IP: srcIP, Port: srcPort}, &net.TCPAddr{IP: dstIP, Port: dstPort}, nil
+}
+
+func readProxyHeaderV2(conn net.Conn, src, dst net.Addr) (net.Addr, net.Addr, error) {
+	hdr := make([]byte, 4)
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		return nil, nil, err
+	}
+	if hdr[0]>>4 != 2 {
+		return nil, nil, fmt.Errorf("unsupported PROXY v2 version byte 0x%02x", hdr[0])
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(hdr[2:4]))
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		return nil, nil, err
+	}
+
+	if hdr[0]&0x0F == 0x00 { // LOCAL, e.g. health checks from the balancer
+		return src, dst, nil
+	}
+
+	switch hdr[1] >> 4 {
+	case 0x1: // AF_INET
+		if len(payload) < 12 {
+			return nil, nil, errors.New("short PROXY v2 IPv4 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))},
+			&net.TCPAddr{IP: net.IP(payload[4:8]), Port: int(binary.BigEndian.Uint16(payload[10:12]))}, nil
+	case 0x2: // AF_INET6
+		if len(payload) < 36 {
+			return nil, nil, errors.New("short PROXY v2 IPv6 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))},
+			&net.TCPAddr{IP: net.IP(payload[16:32]), Port: int(binary.BigEndian.Uint16(payload[34:36]))}, nil
+	}
+	// AF_UNSPEC or AF_UNIX: keep the connection addresses
+	return src, dst, nil
+}
@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func proxyV2Header(b ...byte) string {
+	return string(proxyV2Signature) + string(b)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	tcp := func(s string) net.Addr {
+		addr, err := net.ResolveTCPAddr("tcp", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return addr
+	}
+
+	tests := []struct {
+		name     string
+		header   string
+		src, dst net.Addr // nil = the addresses of the connection
+		wantErr  string
+	}{
+		{
+			name:   "v1 TCP4",
+			header: "PROXY TCP4 192.0.2.1 198.51.100.2 56324 443\r\n",
+			src:    tcp("192.0.2.1:56324"),
+			dst:    tcp("198.51.100.2:443"),
+		},
+		{
+			name:   "v1 TCP6",
+			header: "PROXY TCP6 2001:db8::1 2001:db8::2 1000 2000\r\n",
+			src:    tcp("[2001:db8::1]:1000"),
+			dst:    tcp("[2001:db8::2]:2000"),
+		},
+		{
+			name:   "v1 UNKNOWN",
+			header: "PROXY UNKNOWN\r\n",
+		},
+		{
+			name:   "v1 UNKNOWN with addresses",
+			header: "PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n",
+		},
+		{
+			name:    "v1 too long",
+			header:  "PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n",
+			wantErr: "too long",
+		},
+		{
+			name:    "v1 missing fields",
+			header:  "PROXY TCP4 192.0.2.1 198.51.100.2 56324\r\n",
+			wantErr: "invalid PROXY v1 header",
+		},
+		{
+			name:    "v1 invalid address",
+			header:  "PROXY TCP4 192.0.2.256 198.51.100.2 56324 443\r\n",
+			wantErr: "invalid PROXY v1 header",
+		},
+		{
+			name:    "v1 UDP4",
+			header:  "PROXY UDP4 192.0.2.1 198.51.100.2 56324 443\r\n",
+			wantErr: "invalid PROXY v1 header",
+		},
+		{
+			name:    "no header",
+			header:  "GET / HTTP/1.1\r\n\r\n",
+			wantErr: "missing PROXY protocol header",
+		},
+		{
+			name:   "v2 TCP4",
+			header: string(proxyHeader(ProxyProtocolV2, tcp("192.0.2.1:56324"), tcp("198.51.100.2:443"))),
+			src:    tcp("192.0.2.1:56324"),
+			dst:    tcp("198.51.100.2:443"),
+		},
+		{
+			name:   "v2 TCP6",
+			header: string(proxyHeader(ProxyProtocolV2, tcp("[2001:db8::1]:1000"), tcp("[2001:db8::2]:2000"))),
+			src:    tcp("[2001:db8::1]:1000"),
+			dst:    tcp("[2001:db8::2]:2000"),
+		},
+		{
+			name:   "v2 TLVs after the addresses",
+			header: proxyV2Header(0x21, 0x11, 0x00, 0x10, 192, 0, 2, 1, 198, 51, 100, 2, 0xDC, 0x04, 0x01, 0xBB, 0x04, 0x00, 0x01, 0x00),
+			src:    tcp("192.0.2.1:56324"),
+			dst:    tcp("198.51.100.2:443"),
+		},
+		{
+			name:   "v2 LOCAL",
+			header: proxyV2Header(0x20, 0x00, 0x00, 0x00),
+		},
+		{
+			name:   "v2 LOCAL with addresses",
+			header: proxyV2Header(0x20, 0x11, 0x00, 0x0C, 192, 0, 2, 1, 198, 51, 100, 2, 0xDC, 0x04, 0x01, 0xBB),
+		},
+		{
+			name:   "v2 AF_UNSPEC",
+			header: proxyV2Header(0x21, 0x00, 0x00, 0x00),
+		},
+		{
+			name:    "v2 short IPv4 address block",
+			header:  proxyV2Header(0x21, 0x11, 0x00, 0x04, 192, 0, 2, 1),
+			wantErr: "short PROXY v2 IPv4 address block",
+		},
+		{
+			name:    "v2 short IPv6 address block",
+			header:  proxyV2Header(0x21, 0x21, 0x00, 0x0C, 192, 0, 2, 1, 198, 51, 100, 2, 0xDC, 0x04, 0x01, 0xBB),
+			wantErr: "short PROXY v2 IPv6 address block",
+		},
+		{
+			name:    "v2 truncated payload",
+			header:  proxyV2Header(0x21, 0x11, 0x00, 0x0C, 192, 0, 2, 1),
+			wantErr: io.ErrUnexpectedEOF.Error(),
+		},
+		{
+			name:    "v2 wrong version",
+			header:  proxyV2Header(0x11, 0x11, 0x00, 0x00),
+			wantErr: "unsupported PROXY v2 version",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer server.Close()
+			go func() {
+				client.Write([]byte(tt.header + "data"))
+				client.Close()
+			}()
+
+			src, dst, err := readProxyHeader(server)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			wantSrc, wantDst := tt.src, tt.dst
+			if wantSrc == nil {
+				wantSrc, wantDst = server.RemoteAddr(), server.LocalAddr()
+			}
+			if src.String() != wantSrc.String() || dst.String() != wantDst.String() {
+				t.Errorf("got %s -> %s, want %s -> %s", src, dst, wantSrc, wantDst)
+			}
+
+			// Nothing beyond the header may be consumed
+			rest, err := io.ReadAll(server)
+			if err != nil || string(rest) != "data" {
+				t.Errorf("read after header = %q, %v, want \"data\"", rest, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket measured in bytes. A single limiter may be
+// shared by any number of connections, so all of them together stay within
+// the configured rate. A nil *RateLimiter never blocks.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a limiter allowing rate bytes per second with bursts
+// of up to burst bytes. A burst of 0 defaults to one second worth of traffic.
+// It returns nil if rate is not positive.
+func NewRateLimiter(rate, burst int64) *RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = rate
+	}
+	return &RateLimiter{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Allow reports whether n bytes may be sent now, taking the tokens if so.
+// Unlike Wait it never blocks. Requests larger than the burst are allowed
+// once the bucket is full.
+func (l *RateLimiter) Allow(n int) bool {
+	if l == nil || n <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	if l.tokens < min(float64(n), l.burst) {
+		return false
+	}
+	l.tokens -= float64(n)
+	return true
+}
+
+// Wait blocks until n bytes may be sent. Requests larger than the burst are
+// allowed and simply wait longer. It returns false if stop was closed first.
+func (l *RateLimiter) Wait(n int, stop <-chan struct{}) bool {
+	if l == nil || n <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if wait <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-stop:
+		return false
+	}
+}
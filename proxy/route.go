@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/missuo/traffic-monitor/stats"
+)
+
+// Route sends TLS connections whose SNI hostname matches one of its patterns
+// to its own targets. Each route has its own stats, quota and connection
+// table, so many tenants can be metered through a single listening port.
+type Route struct {
+	Name    string
+	SNI     []string // exact hostnames or wildcards like "*.example.com"
+	Targets *Balancer
+	Stats   *stats.ProxyStats
+	Conns   *ConnTable
+}
+
+// matchRoute returns the route for serverName. Exact hostnames take
+// precedence over wildcards; among wildcards the first match in config order
+// wins. A wildcard "*.example.com" matches any subdomain of example.com, but
+// not example.com itself.
+func matchRoute(routes []*Route, serverName string) *Route {
+	if serverName == "" {
+		return nil
+	}
+	serverName = strings.ToLower(strings.TrimSuffix(serverName, "."))
+
+	for _, r := range routes {
+		for _, pattern := range r.SNI {
+			if strings.EqualFold(pattern, serverName) {
+				return r
+			}
+		}
+	}
+	for _, r := range routes {
+		for _, pattern := range r.SNI {
+			if suffix, ok := strings.CutPrefix(pattern, "*"); ok &&
+				strings.HasSuffix(serverName, strings.ToLower(suffix)) && len(serverName) > len(suffix) {
+				return r
+			}
+		}
+	}
+	return nil
+}
+
+var errClientHelloRead = errors.New("client hello read")
+
+// peekServerName reads the TLS ClientHello from conn without answering it
+// and returns the SNI hostname, "" if the client did not send one or does
+// not speak TLS. The returned connection replays the bytes read so far, so
+// the target receives the untouched stream.
+func peekServerName(conn net.Conn) (string, net.Conn, error) {
+	var buf bytes.Buffer
+	var serverName string
+
+	conn.SetReadDeadline(time.Now().Add(tlsHandshakeTimeout))
+	err := tls.Server(readOnlyConn{Conn: conn, r: io.TeeReader(conn, &buf)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errClientHelloRead
+		},
+	}).Handshake()
+	conn.SetReadDeadline(time.Time{})
+
+	if buf.Len() == 0 {
+		return "", nil, err
+	}
+	return serverName, &prefixConn{Conn: conn, prefix: buf.Bytes()}, nil
+}
+
+// readOnlyConn lets crypto/tls parse a ClientHello without sending anything
+// back to the client.
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c readOnlyConn) Write(b []byte) (int, error) { return 0, io.ErrClosedPipe }
+
+// prefixConn returns bytes that were already read from Conn before reading
+// from Conn again.
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
@@ -0,0 +1,45 @@
+package proxy
+
+import "testing"
+
+func TestMatchRoute(t *testing.T) {
+	exact := &Route{Name: "exact", SNI: []string{"a.example.com", "Mixed.Example.com"}}
+	wildcard := &Route{Name: "wildcard", SNI: []string{"*.example.com"}}
+	deeper := &Route{Name: "deeper", SNI: []string{"*.b.example.com"}}
+	routes := []*Route{wildcard, deeper, exact}
+
+	tests := []struct {
+		serverName string
+		want       *Route
+	}{
+		{"a.example.com", exact},  // exact beats an earlier wildcard
+		{"A.EXAMPLE.COM", exact},  // case insensitive
+		{"a.example.com.", exact}, // trailing dot
+		{"mixed.example.com", exact},
+		{"c.example.com", wildcard},
+		{"x.b.example.com", wildcard}, // first matching wildcard in config order
+		{"example.com", nil},          // a wildcard does not match its own domain
+		{".example.com", nil},         // empty label
+		{"badexample.com", nil},
+		{"example.org", nil},
+		{"", nil},
+	}
+
+	for _, tt := range tests {
+		if got := matchRoute(routes, tt.serverName); got != tt.want {
+			t.Errorf("matchRoute(%q) = %v, want %v", tt.serverName, routeName(got), routeName(tt.want))
+		}
+	}
+
+	// Among wildcards the order of the routes decides
+	if got := matchRoute([]*Route{deeper, wildcard}, "x.b.example.com"); got != deeper {
+		t.Errorf("matchRoute with deeper first = %v, want deeper", routeName(got))
+	}
+}
+
+func routeName(r *Route) string {
+	if r == nil {
+		return "<nil>"
+	}
+	return r.Name
+}
@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"bytes"
+	"net"
+	"time"
+)
+
+// Protocols detected by sniffing the first bytes of a TCP connection.
+const (
+	ProtocolSSH    = "ssh"
+	ProtocolHTTP   = "http"
+	ProtocolTLS    = "tls"
+	ProtocolSOCKS5 = "socks5"
+	ProtocolOther  = "other"
+)
+
+// sniffBufferSize is enough to recognize every protocol below.
+const sniffBufferSize = 16
+
+// textPrefixes identifies protocols that open with a fixed ASCII string.
+var textPrefixes = []struct {
+	prefix   []byte
+	protocol string
+}{
+	{[]byte("SSH-"), ProtocolSSH},
+	{[]byte("GET "), ProtocolHTTP},
+	{[]byte("POST "), ProtocolHTTP},
+	{[]byte("HEAD "), ProtocolHTTP},
+	{[]byte("PUT "), ProtocolHTTP},
+	{[]byte("DELETE "), ProtocolHTTP},
+	{[]byte("OPTIONS "), ProtocolHTTP},
+	{[]byte("PATCH "), ProtocolHTTP},
+	{[]byte("CONNECT "), ProtocolHTTP},
+	{[]byte("TRACE "), ProtocolHTTP},
+}
+
+// classify returns the protocol that starts with b, or false if more bytes
+// are needed to tell.
+func classify(b []byte) (string, bool) {
+	if len(b) == 0 {
+		return "", false
+	}
+
+	switch b[0] {
+	case 0x16: // TLS handshake record
+		if len(b) < 2 {
+			return "", false
+		}
+		if b[1] == 0x03 {
+			return ProtocolTLS, true
+		}
+		return ProtocolOther, true
+	case 0x05: // SOCKS5 greeting: version, number of methods
+		if len(b) < 2 {
+			return "", false
+		}
+		if b[1] > 0 {
+			return ProtocolSOCKS5, true
+		}
+		return ProtocolOther, true
+	}
+
+	more := false
+	for _, t := range textPrefixes {
+		if bytes.HasPrefix(b, t.prefix) {
+			return t.protocol, true
+		}
+		if bytes.HasPrefix(t.prefix, b) {
+			more = true
+		}
+	}
+	if more {
+		return "", false
+	}
+	return ProtocolOther, true
+}
+
+// sniffProtocol reads from conn until the protocol can be told apart and
+// returns it together with a connection that replays the bytes read. A
+// client that sends nothing within timeout is classified as ProtocolOther,
+// so protocols where the server speaks first still reach the fallback.
+func sniffProtocol(conn net.Conn, timeout time.Duration) (string, net.Conn, error) {
+	buf := make([]byte, sniffBufferSize)
+	var n int
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	for {
+		m, err := conn.Read(buf[n:])
+		n += m
+		if protocol, ok := classify(buf[:n]); ok {
+			return protocol, &prefixConn{Conn: conn, prefix: buf[:n]}, nil
+		}
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				return ProtocolOther, &prefixConn{Conn: conn, prefix: buf[:n]}, nil
+			}
+			return "", nil, err
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"runtime"
+)
+
+// spliceSupported reports whether (*net.TCPConn).ReadFrom moves data between
+// two TCP connections with splice(2), without copying it to userspace.
+const spliceSupported = runtime.GOOS == "linux"
+
+// maxSpliceChunk is the most the zero-copy path forwards between two limit
+// checks when limit_check is larger or unset.
+const maxSpliceChunk = 1 << 20
+
+// errNoZeroCopy tells copy to continue in userspace, either because the
+// connections cannot be spliced or because a rate limit now applies.
+var errNoZeroCopy = errors.New("zero-copy not possible")
+
+// zeroCopy is the fast path of copy for plain TCP connections. It forwards
+// src to dst in chunks of limit_check bytes, each moved by the kernel, and
+// accounts and re-checks the limits after every chunk exactly like copy.
+func (p *TCPProxy) zeroCopy(dst, src net.Conn, route *Route, flow *Flow, isUpload bool) error {
+	// Bytes read ahead while sniffing or peeking at the ClientHello go first
+	if pc, ok := src.(*prefixConn); ok && len(pc.prefix) > 0 {
+		n, err := dst.Write(pc.prefix)
+		if n > 0 {
+			account(route, flow, isUpload, int64(n))
+		}
+		pc.prefix = pc.prefix[n:]
+		if err != nil {
+			return err
+		}
+	}
+
+	dstTCP, srcTCP, ok := spliceConns(dst, src)
+	if !ok {
+		return errNoZeroCopy
+	}
+
+	chunk := p.opts.LimitCheck
+	if chunk <= 0 {
+		chunk = copyBufferSize // same granularity as a userspace read
+	} else if chunk > maxSpliceChunk {
+		chunk = maxSpliceChunk
+	}
+
+	lr := &io.LimitedReader{R: srcTCP}
+	for {
+		lr.N = chunk
+		n, err := dstTCP.ReadFrom(lr)
+		if n > 0 {
+			account(route, flow, isUpload, n)
+		}
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil // EOF
+		}
+
+		exceeded, blocked := checkLimit(route.Name, route.Stats)
+		if blocked {
+			return errLimitExceeded
+		}
+		clientLimiter, blocked := p.opts.clientLimit(route.Name, route.Stats, flow.clientKey, flow.client, isUpload)
+		if blocked {
+			return errClientLimitExceeded
+		}
+		if p.opts.limiter(isUpload, exceeded) != nil || clientLimiter != nil {
+			return errNoZeroCopy // Throttled from now on
+		}
+	}
+}
+
+// spliceConns returns the TCP connections underneath dst and src, or false
+// if either is not a plain TCP connection or src still has bytes buffered.
+func spliceConns(dst, src net.Conn) (*net.TCPConn, *net.TCPConn, bool) {
+	for {
+		pc, ok := dst.(*prefixConn)
+		if !ok {
+			break
+		}
+		dst = pc.Conn
+	}
+	for {
+		pc, ok := src.(*prefixConn)
+		if !ok || len(pc.prefix) > 0 {
+			break
+		}
+		src = pc.Conn
+	}
+
+	dstTCP, ok := dst.(*net.TCPConn)
+	if !ok {
+		return nil, nil, false
+	}
+	srcTCP, ok := src.(*net.TCPConn)
+	if !ok {
+		return nil, nil, false
+	}
+	return dstTCP, srcTCP, true
+}
@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/missuo/traffic-monitor/stats"
+)
+
+// BenchmarkTCPProxyUserspace and BenchmarkTCPProxyZeroCopy compare the
+// throughput of one connection forwarded through a userspace buffer and
+// through splice(2):
+//
+//	go test -bench TCPProxy -benchmem ./proxy/
+func BenchmarkTCPProxyUserspace(b *testing.B) {
+	benchmarkTCPProxy(b, true)
+}
+
+func BenchmarkTCPProxyZeroCopy(b *testing.B) {
+	if !spliceSupported {
+		b.Skip("splice(2) is only used on Linux")
+	}
+	benchmarkTCPProxy(b, false)
+}
+
+func benchmarkTCPProxy(b *testing.B, disableZeroCopy bool) {
+	const chunkSize = 1 << 20
+
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	// Target that discards everything and reports how much it received
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer target.Close()
+	received := make(chan int64, 1)
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			received <- 0
+			return
+		}
+		n, _ := io.Copy(io.Discard, conn)
+		conn.Close()
+		received <- n
+	}()
+
+	s := stats.NewStatsManager().Register("bench", "tcp", 0, 0, 0, 0, stats.PolicyBlock)
+	targets, err := NewBalancer("", []*Target{{Addr: target.Addr().String()}}, nil, s)
+	if err != nil {
+		b.Fatal(err)
+	}
+	p := NewTCPProxy("bench", "127.0.0.1:0", targets, s, Options{
+		LimitCheck:      maxSpliceChunk,
+		DisableZeroCopy: disableZeroCopy,
+	})
+	if err := p.Start(); err != nil {
+		b.Fatal(err)
+	}
+	defer p.Stop()
+
+	conn, err := net.Dial("tcp", p.listener.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	chunk := make([]byte, chunkSize)
+	b.SetBytes(chunkSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := conn.Write(chunk); err != nil {
+			b.Fatal(err)
+		}
+	}
+	conn.(*net.TCPConn).CloseWrite()
+	n := <-received
+	b.StopTimer()
+
+	if want := int64(b.N) * chunkSize; n != want || atomic.LoadInt64(&s.TotalUpload) != want {
+		b.Fatalf("target received %d bytes, stats counted %d, want %d", n, atomic.LoadInt64(&s.TotalUpload), want)
+	}
+}
@@ -1,18 +1,29 @@
 package proxy
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/missuo/traffic-monitor/stats"
 )
 
+var (
+	errLimitExceeded       = errors.New("traffic limit exceeded")
+	errClientLimitExceeded = errors.New("client traffic limit exceeded")
+)
+
+const copyBufferSize = 32 * 1024 // 32KB buffer
+
 var bufferPool = sync.Pool{
 	New: func() interface{} {
-		buf := make([]byte, 32*1024) // 32KB buffer
+		buf := make([]byte, copyBufferSize)
 		return &buf
 	},
 }
@@ -20,21 +31,50 @@ var bufferPool = sync.Pool{
 type TCPProxy struct {
 	name       string
 	listenAddr string
-	targetAddr string
+	targets    *Balancer
 	stats      *stats.ProxyStats
+	opts       Options
 	listener   net.Listener
-	stopCh     chan struct{}
+	stopCh     chan struct{} // closed to stop accepting connections
+	killCtx    context.Context
+	kill       context.CancelFunc // aborts connections, and dials, that did not drain
 	wg         sync.WaitGroup
+	flowsMu    sync.Mutex
+	flows      map[*Flow]struct{}
+	conns      map[net.Conn]struct{} // accepted connections, including those not yet dialed
+
+	// defaultRoute serves connections that match none of opts.Routes,
+	// nil if the proxy has no targets of its own. sniffRoutes holds the
+	// routes for protocols with their own targets.
+	defaultRoute *Route
+	sniffRoutes  map[string]*Route
 }
 
-func NewTCPProxy(name string, listenPort int, targetHost string, targetPort int, s *stats.ProxyStats) *TCPProxy {
-	return &TCPProxy{
+func NewTCPProxy(name, listenAddr string, targets *Balancer, s *stats.ProxyStats, opts Options) *TCPProxy {
+	if opts.Conns == nil {
+		opts.Conns = NewConnTable()
+	}
+	p := &TCPProxy{
 		name:       name,
-		listenAddr: fmt.Sprintf(":%d", listenPort),
-		targetAddr: fmt.Sprintf("%s:%d", targetHost, targetPort),
+		listenAddr: listenAddr,
+		targets:    targets,
 		stats:      s,
+		opts:       opts,
 		stopCh:     make(chan struct{}),
+		flows:      make(map[*Flow]struct{}),
+		conns:      make(map[net.Conn]struct{}),
+	}
+	p.killCtx, p.kill = context.WithCancel(context.Background())
+	if targets != nil {
+		p.defaultRoute = &Route{Name: name, Targets: targets, Stats: s, Conns: opts.Conns}
 	}
+	if len(opts.SniffTargets) > 0 {
+		p.sniffRoutes = make(map[string]*Route)
+		for protocol, b := range opts.SniffTargets {
+			p.sniffRoutes[protocol] = &Route{Name: name, Targets: b, Stats: s, Conns: opts.Conns}
+		}
+	}
+	return p
 }
 
 func (p *TCPProxy) Start() error {
@@ -43,7 +83,17 @@ func (p *TCPProxy) Start() error {
 		return fmt.Errorf("failed to listen on %s: %w", p.listenAddr, err)
 	}
 	p.listener = listener
-	log.Printf("[TCP] %s: listening on %s -> %s", p.name, p.listenAddr, p.targetAddr)
+	if p.targets != nil {
+		log.Printf("[TCP] %s: listening on %s -> %s", p.name, p.listenAddr, p.targets)
+	} else {
+		log.Printf("[TCP] %s: listening on %s, SNI routes only", p.name, p.listenAddr)
+	}
+	for _, r := range p.opts.Routes {
+		log.Printf("[TCP] %s: route %s %v -> %s", p.name, r.Name, r.SNI, r.Targets)
+	}
+	for protocol, b := range p.opts.SniffTargets {
+		log.Printf("[TCP] %s: %s -> %s", p.name, protocol, b)
+	}
 
 	p.wg.Add(1)
 	go p.acceptLoop()
@@ -51,12 +101,37 @@ func (p *TCPProxy) Start() error {
 	return nil
 }
 
+// Stop stops accepting connections and waits for active ones to finish.
+// Connections still open after the shutdown timeout are closed.
 func (p *TCPProxy) Stop() {
 	close(p.stopCh)
 	if p.listener != nil {
 		p.listener.Close()
 	}
-	p.wg.Wait()
+
+	p.flowsMu.Lock()
+	active := len(p.conns)
+	p.flowsMu.Unlock()
+	if active > 0 {
+		log.Printf("[TCP] %s: draining %d active connections", p.name, active)
+	}
+
+	if !waitTimeout(&p.wg, p.opts.ShutdownTimeout) {
+		p.flowsMu.Lock()
+		log.Printf("[TCP] %s: shutdown timeout reached, closing %d connections", p.name, len(p.conns))
+		for f := range p.flows {
+			f.setCloseReason(CloseShutdown)
+			f.Close()
+		}
+		// Connections still reading a PROXY header, sniffing or peeking at
+		// the ClientHello have no flow yet
+		for conn := range p.conns {
+			conn.Close()
+		}
+		p.flowsMu.Unlock()
+		p.kill()
+		p.wg.Wait()
+	}
 }
 
 func (p *TCPProxy) acceptLoop() {
@@ -80,70 +155,342 @@ func (p *TCPProxy) acceptLoop() {
 			}
 		}
 
-		go p.handleConn(conn)
+		// Clients behind a trusted PROXY upstream are checked once their
+		// header has been read
+		if !(p.opts.AcceptProxyProtocol && p.opts.trustedUpstream(conn.RemoteAddr())) && !p.admit(conn.RemoteAddr()) {
+			conn.Close()
+			continue
+		}
+
+		p.flowsMu.Lock()
+		p.conns[conn] = struct{}{}
+		p.flowsMu.Unlock()
+
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			defer func() {
+				p.flowsMu.Lock()
+				delete(p.conns, conn)
+				p.flowsMu.Unlock()
+			}()
+			p.handleConn(conn)
+		}()
 	}
 }
 
+// admit checks a new client against the access control lists and the bans,
+// and counts the connection towards the client's ban thresholds.
+func (p *TCPProxy) admit(clientAddr net.Addr) bool {
+	if !p.opts.allowed(clientAddr) {
+		atomic.AddInt64(&p.stats.Rejected.Denied, 1)
+		return false
+	}
+	ip := hostOf(clientAddr)
+	if p.opts.Bans.Banned(ip) {
+		atomic.AddInt64(&p.stats.Rejected.Banned, 1)
+		return false
+	}
+	p.opts.Bans.Record(ip, BanConnections)
+	return true
+}
+
 func (p *TCPProxy) handleConn(src net.Conn) {
 	defer src.Close()
 
-	if p.stats.IsLimitExceeded() {
-		log.Printf("[TCP] %s: connection rejected, traffic limit exceeded", p.name)
+	clientAddr, localAddr := src.RemoteAddr(), src.LocalAddr()
+	if p.opts.AcceptProxyProtocol && p.opts.trustedUpstream(clientAddr) {
+		var err error
+		clientAddr, localAddr, err = readProxyHeader(src)
+		if err != nil {
+			log.Printf("[TCP] %s: failed to read PROXY header from %s: %v", p.name, src.RemoteAddr(), err)
+			return
+		}
+		if !p.admit(clientAddr) {
+			return
+		}
+	}
+
+	ip := hostOf(clientAddr)
+	start := time.Now()
+
+	if err := p.opts.ConnLimiter.Acquire(ip); err != nil {
+		if err == errMaxConnections {
+			atomic.AddInt64(&p.stats.Rejected.MaxConnections, 1)
+		} else {
+			atomic.AddInt64(&p.stats.Rejected.MaxConnectionsPerIP, 1)
+			p.opts.Bans.Record(ip, BanRejections)
+		}
+		log.Printf("[TCP] %s: connection from %s rejected, %v", p.name, clientAddr, err)
+		return
+	}
+	defer p.opts.ConnLimiter.Release(ip)
+
+	var raw *countingConn
+	var terminated *tls.Conn
+	if p.opts.TLS != nil {
+		raw = &countingConn{Conn: src}
+		tlsConn := tls.Server(raw, p.opts.TLS)
+		tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+		if err := tlsConn.HandshakeContext(p.killCtx); err != nil {
+			atomic.AddInt64(&p.stats.Errors.ClientTLSHandshake, 1)
+			p.stats.TLSOverhead.AddUpload(atomic.LoadInt64(&raw.read))
+			p.stats.TLSOverhead.AddDownload(atomic.LoadInt64(&raw.written))
+			log.Printf("[TCP] %s: TLS handshake with %s failed: %v", p.name, clientAddr, err)
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+		src = tlsConn
+		terminated = tlsConn
+	}
+
+	route := p.defaultRoute
+	var protocol string
+	if p.opts.Sniff {
+		var err error
+		protocol, src, err = sniffProtocol(src, p.opts.SniffTimeout)
+		if err != nil {
+			log.Printf("[TCP] %s: failed to read from %s: %v", p.name, clientAddr, err)
+			return
+		}
+		if r := p.sniffRoutes[protocol]; r != nil {
+			route = r
+		}
+	}
+
+	// Only TLS carries a server name; sniffed protocols other than TLS keep their route
+	var serverName string
+	if len(p.opts.Routes) > 0 && (terminated != nil || !p.opts.Sniff || protocol == ProtocolTLS) {
+		if terminated != nil {
+			serverName = terminated.ConnectionState().ServerName
+		} else {
+			var err error
+			serverName, src, err = peekServerName(src)
+			if err != nil {
+				log.Printf("[TCP] %s: failed to read ClientHello from %s: %v", p.name, clientAddr, err)
+				return
+			}
+		}
+		if r := matchRoute(p.opts.Routes, serverName); r != nil {
+			route = r
+		}
+	}
+	if route == nil {
+		atomic.AddInt64(&p.stats.Rejected.NoRoute, 1)
+		log.Printf("[TCP] %s: connection from %s rejected, no route for protocol %q, server name %q",
+			p.name, clientAddr, protocol, serverName)
 		return
 	}
+	s := route.Stats
 
-	dst, err := net.Dial("tcp", p.targetAddr)
+	if _, blocked := checkLimit(route.Name, s); blocked {
+		atomic.AddInt64(&s.Rejected.LimitExceeded, 1)
+		log.Printf("[TCP] %s: connection rejected, traffic limit exceeded", route.Name)
+		return
+	}
+
+	var clientKey string
+	var client *stats.ClientTraffic
+	if p.opts.ClientStats != nil {
+		clientKey = p.opts.ClientStats.Key(clientAddr)
+		client = s.Clients.Get(clientKey)
+		if _, blocked := p.opts.clientLimit(route.Name, s, clientKey, client, true); blocked {
+			atomic.AddInt64(&s.Rejected.ClientLimitExceeded, 1)
+			p.opts.Bans.Record(ip, BanRejections)
+			log.Printf("[TCP] %s: connection from %s rejected, client traffic limit exceeded", route.Name, clientAddr)
+			return
+		}
+	}
+
+	// Refused connections count as rejections only, not as short-lived ones
+	defer p.opts.Bans.Closed(ip, start)
+
+	atomic.AddInt64(&s.ActiveConnections, 1)
+	defer atomic.AddInt64(&s.ActiveConnections, -1)
+
+	target := route.Targets.Next(ip)
+	target.acquire()
+	defer target.release()
+
+	dst, err := p.opts.Dialer.DialContext(p.killCtx, "tcp", target.Addr)
 	if err != nil {
-		log.Printf("[TCP] %s: failed to connect to target %s: %v", p.name, p.targetAddr, err)
+		atomic.AddInt64(&s.Errors.TargetDial, 1)
+		p.opts.Bans.Record(ip, BanDialErrors)
+		p.opts.logDialError(route.Name, "tcp", clientAddr, target.Addr, start)
+		log.Printf("[TCP] %s: failed to connect to target %s: %v", route.Name, target.Addr, err)
 		return
 	}
 	defer dst.Close()
 
+	if p.opts.SendProxyProtocol != 0 {
+		header := proxyHeader(p.opts.SendProxyProtocol, clientAddr, localAddr)
+		if _, err := dst.Write(header); err != nil {
+			log.Printf("[TCP] %s: failed to send PROXY header to target %s: %v", route.Name, target.Addr, err)
+			return
+		}
+	}
+
+	if p.opts.TargetTLS != nil {
+		tlsConn := tls.Client(dst, clientTLSConfig(p.opts.TargetTLS, target.Addr))
+		tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+		if err := tlsConn.HandshakeContext(p.killCtx); err != nil {
+			atomic.AddInt64(&s.Errors.TargetTLSHandshake, 1)
+			p.opts.logDialError(route.Name, "tcp", clientAddr, target.Addr, start)
+			log.Printf("[TCP] %s: TLS handshake with target %s failed: %v", route.Name, target.Addr, err)
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+		dst = tlsConn
+	}
+
+	flow := route.Conns.Add("tcp", clientAddr.String(), dst.RemoteAddr().String(), func() {
+		src.Close()
+		dst.Close()
+	})
+	flow.track(target.traffic)
+	flow.track(s.Families.Get(addressFamily(clientAddr)))
+	if client != nil {
+		flow.trackClient(clientKey, client)
+	}
+	if protocol != "" {
+		flow.track(s.Protocols.Get(protocol))
+	}
+	defer route.Conns.Remove(flow)
+	defer p.opts.logFlow(route.Name, flow, start)
+
+	if raw != nil {
+		defer addTLSOverhead(s, raw, flow)
+	}
+
+	p.flowsMu.Lock()
+	p.flows[flow] = struct{}{}
+	p.flowsMu.Unlock()
+	defer func() {
+		p.flowsMu.Lock()
+		delete(p.flows, flow)
+		p.flowsMu.Unlock()
+	}()
+
+	var closeOnce sync.Once
+	closeOnLimit := func(err error) {
+		flow.setCloseReason(CloseLimitExceeded)
+		closeOnce.Do(func() {
+			if err == errClientLimitExceeded {
+				log.Printf("[TCP] %s: closing connection from %s, client %s limit exceeded",
+					route.Name, clientAddr, s.ClientExceededLimit(client))
+			} else {
+				log.Printf("[TCP] %s: closing connection from %s, %s limit exceeded",
+					route.Name, clientAddr, s.ExceededLimit())
+			}
+			src.Close()
+			dst.Close()
+		})
+	}
+
 	var wg sync.WaitGroup
 	wg.Add(2)
 
 	// Client -> Target (Upload)
 	go func() {
 		defer wg.Done()
-		p.copy(dst, src, true)
-		dst.(*net.TCPConn).CloseWrite()
+		err := p.copy(dst, src, route, flow, true)
+		if err == errLimitExceeded || err == errClientLimitExceeded {
+			closeOnLimit(err)
+			return
+		}
+		flow.setCloseReason(closeReason(err))
+		closeWrite(dst)
 	}()
 
 	// Target -> Client (Download)
 	go func() {
 		defer wg.Done()
-		p.copy(src, dst, false)
-		src.(*net.TCPConn).CloseWrite()
+		err := p.copy(src, dst, route, flow, false)
+		if err == errLimitExceeded || err == errClientLimitExceeded {
+			closeOnLimit(err)
+			return
+		}
+		flow.setCloseReason(closeReason(err))
+		closeWrite(src)
 	}()
 
 	wg.Wait()
 }
 
-func (p *TCPProxy) copy(dst, src net.Conn, isUpload bool) {
+// addTLSOverhead records the raw bytes of a TLS connection that did not
+// carry application data.
+func addTLSOverhead(s *stats.ProxyStats, raw *countingConn, flow *Flow) {
+	if n := atomic.LoadInt64(&raw.read) - flow.Upload(); n > 0 {
+		s.TLSOverhead.AddUpload(n)
+	}
+	if n := atomic.LoadInt64(&raw.written) - flow.Download(); n > 0 {
+		s.TLSOverhead.AddDownload(n)
+	}
+}
+
+func (p *TCPProxy) copy(dst, src net.Conn, route *Route, flow *Flow, isUpload bool) error {
 	bufPtr := bufferPool.Get().(*[]byte)
 	defer bufferPool.Put(bufPtr)
 	buf := *bufPtr
 
+	exceeded, _ := checkLimit(route.Name, route.Stats)
+	limiter := p.opts.limiter(isUpload, exceeded)
+	clientLimiter, _ := p.opts.clientLimit(route.Name, route.Stats, flow.clientKey, flow.client, isUpload)
+
+	// Bulk transfers switch to splice(2) once a read fills the buffer;
+	// interactive traffic stays here, where counters follow every read
+	trySplice := spliceSupported && !p.opts.DisableZeroCopy
+
+	var unchecked int64
 	for {
 		n, readErr := src.Read(buf)
 		if n > 0 {
+			if !limiter.Wait(n, p.killCtx.Done()) || !clientLimiter.Wait(n, p.killCtx.Done()) {
+				return net.ErrClosed
+			}
 			written, writeErr := dst.Write(buf[:n])
 			if written > 0 {
-				if isUpload {
-					p.stats.AddUpload(int64(written))
-				} else {
-					p.stats.AddDownload(int64(written))
-				}
+				account(route, flow, isUpload, int64(written))
+				unchecked += int64(written)
 			}
 			if writeErr != nil {
-				return
+				return writeErr
+			}
+			if unchecked >= p.opts.LimitCheck {
+				unchecked = 0
+				exceeded, blocked := checkLimit(route.Name, route.Stats)
+				if blocked {
+					return errLimitExceeded
+				}
+				limiter = p.opts.limiter(isUpload, exceeded)
+				if clientLimiter, blocked = p.opts.clientLimit(route.Name, route.Stats, flow.clientKey, flow.client, isUpload); blocked {
+					return errClientLimitExceeded
+				}
 			}
 		}
 		if readErr != nil {
-			if readErr != io.EOF {
-				// Log non-EOF errors if needed
+			return readErr
+		}
+
+		if trySplice && n == len(buf) && limiter == nil && clientLimiter == nil {
+			if err := p.zeroCopy(dst, src, route, flow, isUpload); err != errNoZeroCopy {
+				return err
 			}
-			return
+			trySplice = false
+			exceeded, _ := checkLimit(route.Name, route.Stats)
+			limiter = p.opts.limiter(isUpload, exceeded)
+			clientLimiter, _ = p.opts.clientLimit(route.Name, route.Stats, flow.clientKey, flow.client, isUpload)
 		}
 	}
 }
+
+// account adds n forwarded bytes to the route's stats and the flow.
+func account(route *Route, flow *Flow, isUpload bool, n int64) {
+	if isUpload {
+		route.Stats.AddUpload(n)
+		flow.AddUpload(n)
+	} else {
+		route.Stats.AddDownload(n)
+		flow.AddDownload(n)
+	}
+}
@@ -0,0 +1,234 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	tlsHandshakeTimeout = 10 * time.Second
+	certCheckInterval   = 10 * time.Second // how often certificate files are checked for changes
+)
+
+// ParseTLSVersion parses "1.0" to "1.3". An empty string defaults to 1.2.
+func ParseTLSVersion(s string) (uint16, error) {
+	switch s {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version: %s", s)
+}
+
+// NewServerTLSConfig builds the TLS configuration of a listener. The
+// certificate is reloaded when its files change on disk. With a client CA,
+// clients must present a certificate signed by it.
+func NewServerTLSConfig(name, certFile, keyFile, minVersion, clientCAFile string, alpn []string) (*tls.Config, error) {
+	version, err := ParseTLSVersion(minVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	reloader, err := newCertReloader(name, certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{
+		GetCertificate: reloader.GetCertificate,
+		MinVersion:     version,
+		NextProtos:     alpn,
+	}
+
+	if clientCAFile != "" {
+		pool, err := loadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return cfg, nil
+}
+
+// NewClientTLSConfig builds the TLS configuration used towards targets. An
+// empty serverName verifies each target against its own host name.
+func NewClientTLSConfig(serverName, caFile, certFile, keyFile string, insecureSkipVerify bool) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: insecureSkipVerify,
+	}
+
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
+
+// clientTLSConfig returns cfg for a connection to addr, filling in the
+// server name from addr when none is configured.
+func clientTLSConfig(cfg *tls.Config, addr string) *tls.Config {
+	if cfg.ServerName != "" {
+		return cfg
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return cfg
+	}
+	cfg = cfg.Clone()
+	cfg.ServerName = host
+	return cfg
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+// certReloader serves a certificate and reloads it when the certificate or
+// key file is modified.
+type certReloader struct {
+	name     string
+	certFile string
+	keyFile  string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+func newCertReloader(name, certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{
+		name:     name,
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	r.cert = &cert
+	r.modTime = modTime
+	r.lastCheck = time.Now()
+	return r, nil
+}
+
+func (r *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.lastCheck) < certCheckInterval {
+		return r.cert, nil
+	}
+	r.lastCheck = time.Now()
+
+	modTime, err := r.latestModTime()
+	if err != nil || !modTime.After(r.modTime) {
+		return r.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		// Files may be mid-update, keep serving the old certificate
+		log.Printf("[TLS] %s: failed to reload certificate: %v", r.name, err)
+		return r.cert, nil
+	}
+	r.cert = &cert
+	r.modTime = modTime
+	log.Printf("[TLS] %s: reloaded certificate %s", r.name, r.certFile)
+	return r.cert, nil
+}
+
+// countingConn counts the raw bytes read from and written to a connection,
+// so TLS record overhead can be told apart from application data.
+type countingConn struct {
+	net.Conn
+	read    int64
+	written int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.read, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.written, int64(n))
+	return n, err
+}
+
+// closeWrite half-closes c. For TLS connections it sends close_notify and
+// then shuts down the write side of the underlying connection as well.
+func closeWrite(c net.Conn) {
+	if tc, ok := c.(*tls.Conn); ok {
+		tc.CloseWrite()
+		c = tc.NetConn()
+	}
+	for {
+		pc, ok := c.(*prefixConn)
+		if !ok {
+			break
+		}
+		c = pc.Conn
+	}
+	if cc, ok := c.(*countingConn); ok {
+		c = cc.Conn
+	}
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+}
@@ -5,47 +5,85 @@ import (
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/missuo/traffic-monitor/stats"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
 const (
-	udpBufferSize   = 65535
-	udpTimeout      = 60 * time.Second
-	cleanupInterval = 30 * time.Second
+	defaultUDPTimeout         = 60 * time.Second
+	defaultUDPCleanupInterval = time.Second
+	defaultUDPBufferSize      = 65535
+
+	udpBatchSize        = 64          // max datagrams per system call on the listener
+	udpSessionBatchSize = 16          // max datagrams per system call on a session's target socket
+	udpDrainIdle        = time.Second // idle time after which a session counts as finished during shutdown
+	maxUDPRejected      = 10000       // refused clients remembered, refusals beyond are counted per datagram
 )
 
 type udpClient struct {
 	targetConn *net.UDPConn
+	targetIO   batchConn
 	clientAddr *net.UDPAddr
-	lastActive time.Time
+	target     *Target
+	flow       *Flow
+	header     []byte      // PROXY header still to be sent with the first datagram
+	timer      *time.Timer // fires when the session may have been idle for UDPTimeout
 }
 
 type UDPProxy struct {
 	name       string
 	listenAddr string
-	targetAddr *net.UDPAddr
+	targets    *Balancer
+	targetAddr map[*Target]*net.UDPAddr
 	stats      *stats.ProxyStats
+	opts       Options
 	listener   *net.UDPConn
+	listenIO   batchConn
 	clients    map[string]*udpClient
 	clientsMu  sync.RWMutex
+	rejected   map[string]time.Time // refused clients, until when their refusal is not counted again
+	drainCh    chan struct{}        // closed to stop creating client sessions
 	stopCh     chan struct{}
 	wg         sync.WaitGroup
 }
 
-func NewUDPProxy(name string, listenPort int, targetHost string, targetPort int, s *stats.ProxyStats) (*UDPProxy, error) {
-	targetAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", targetHost, targetPort))
-	if err != nil {
-		return nil, fmt.Errorf("failed to resolve target address: %w", err)
+func NewUDPProxy(name, listenAddr string, targets *Balancer, s *stats.ProxyStats, opts Options) (*UDPProxy, error) {
+	if opts.Conns == nil {
+		opts.Conns = NewConnTable()
+	}
+	if opts.UDPTimeout <= 0 {
+		opts.UDPTimeout = defaultUDPTimeout
+	}
+	if opts.UDPCleanupInterval <= 0 {
+		opts.UDPCleanupInterval = defaultUDPCleanupInterval
+	}
+	if opts.UDPBufferSize <= 0 {
+		opts.UDPBufferSize = defaultUDPBufferSize
+	}
+
+	targetAddr := make(map[*Target]*net.UDPAddr)
+	for _, t := range targets.Targets() {
+		addr, err := opts.Dialer.ResolveUDPAddr(t.Addr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve target address %s: %w", t.Addr, err)
+		}
+		targetAddr[t] = addr
 	}
 
 	return &UDPProxy{
 		name:       name,
-		listenAddr: fmt.Sprintf(":%d", listenPort),
+		listenAddr: listenAddr,
+		targets:    targets,
 		targetAddr: targetAddr,
 		stats:      s,
+		opts:       opts,
 		clients:    make(map[string]*udpClient),
+		rejected:   make(map[string]time.Time),
+		drainCh:    make(chan struct{}),
 		stopCh:     make(chan struct{}),
 	}, nil
 }
@@ -61,47 +99,64 @@ func (p *UDPProxy) Start() error {
 		return fmt.Errorf("failed to listen on %s: %w", p.listenAddr, err)
 	}
 	p.listener = listener
-	log.Printf("[UDP] %s: listening on %s -> %s", p.name, p.listenAddr, p.targetAddr.String())
+	p.listenIO = newBatchConn(listener)
+	log.Printf("[UDP] %s: listening on %s -> %s", p.name, p.listenAddr, p.targets)
 
-	p.wg.Add(2)
+	p.wg.Add(1)
 	go p.readLoop()
-	go p.cleanupLoop()
 
 	return nil
 }
 
+// Stop stops creating client sessions and lets existing ones finish. A
+// session counts as finished once it has been idle for udpDrainIdle;
+// sessions still active after the shutdown timeout are closed.
 func (p *UDPProxy) Stop() {
+	close(p.drainCh)
+
+	p.clientsMu.RLock()
+	active := len(p.clients)
+	p.clientsMu.RUnlock()
+	if active > 0 {
+		log.Printf("[UDP] %s: draining %d active sessions", p.name, active)
+	}
+
+	deadline := time.Now().Add(p.opts.ShutdownTimeout)
+	for p.expireClients(udpDrainIdle) > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+
 	close(p.stopCh)
 	if p.listener != nil {
 		p.listener.Close()
 	}
 
 	p.clientsMu.Lock()
-	for _, client := range p.clients {
-		client.targetConn.Close()
+	if len(p.clients) > 0 {
+		log.Printf("[UDP] %s: shutdown timeout reached, closing %d sessions", p.name, len(p.clients))
+	}
+	closed := make([]*udpClient, 0, len(p.clients))
+	for key, client := range p.clients {
+		client.flow.setCloseReason(CloseShutdown)
+		p.closeClient(key, client)
+		closed = append(closed, client)
 	}
 	p.clientsMu.Unlock()
+	p.logClosed(closed...)
 
 	p.wg.Wait()
 }
 
+// readLoop reads batches of datagrams from clients and forwards each run of
+// consecutive datagrams from one client to its target with a single write.
+// It blocks in ReadBatch until Stop closes the listener.
 func (p *UDPProxy) readLoop() {
 	defer p.wg.Done()
 
-	buf := make([]byte, udpBufferSize)
+	batch := newUDPBatch(udpBatchSize, p.opts.UDPBufferSize)
 	for {
-		select {
-		case <-p.stopCh:
-			return
-		default:
-		}
-
-		p.listener.SetReadDeadline(time.Now().Add(time.Second))
-		n, clientAddr, err := p.listener.ReadFromUDP(buf)
+		n, err := batch.read(p.listenIO)
 		if err != nil {
-			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				continue
-			}
 			select {
 			case <-p.stopCh:
 				return
@@ -111,23 +166,81 @@ func (p *UDPProxy) readLoop() {
 			}
 		}
 
-		if p.stats.IsLimitExceeded() {
-			continue // Drop packet when limit exceeded
+		exceeded, blocked := checkLimit(p.name, p.stats)
+		if blocked {
+			continue // Drop the batch when limit exceeded
 		}
 
-		p.stats.AddUpload(int64(n))
+		msgs := batch.msgs[:n]
+		for len(msgs) > 0 {
+			clientAddr := msgs[0].Addr.(*net.UDPAddr)
+			run := 1
+			for run < len(msgs) && sameUDPAddr(msgs[run].Addr.(*net.UDPAddr), clientAddr) {
+				run++
+			}
 
-		client := p.getOrCreateClient(clientAddr)
-		if client == nil {
-			continue
+			// ACL changes leave established sessions alone, like TCP
+			// connections; bans apply to them too
+			client := p.lookupClient(clientAddr.String())
+			if client == nil && !p.opts.allowed(clientAddr) {
+				atomic.AddInt64(&p.stats.Rejected.Denied, int64(run))
+			} else if p.opts.Bans.Banned(clientAddr.IP.String()) {
+				atomic.AddInt64(&p.stats.Rejected.Banned, int64(run))
+			} else {
+				if client == nil {
+					client = p.getOrCreateClient(clientAddr)
+				}
+				if client != nil && !p.forwardToTarget(client, msgs[:run], exceeded) {
+					return
+				}
+			}
+			msgs = msgs[run:]
 		}
+	}
+}
 
-		client.lastActive = time.Now()
-		_, err = client.targetConn.Write(buf[:n])
-		if err != nil {
-			log.Printf("[UDP] %s: write to target error: %v", p.name, err)
-		}
+// forwardToTarget writes datagrams received from client to its target and
+// accounts them as one upload. It returns false if the proxy stopped while
+// waiting for the rate limiter.
+func (p *UDPProxy) forwardToTarget(client *udpClient, msgs []ipv4.Message, exceeded bool) bool {
+	clientLimiter, blocked := p.opts.clientLimit(p.name, p.stats, client.flow.clientKey, client.flow.client, true)
+	if blocked {
+		return true // Drop the client's datagrams when its limit is exceeded
+	}
+
+	var size int
+	for i := range msgs {
+		msgs[i].Addr = nil // The target socket is connected
+		size += msgs[i].N
+	}
+
+	// Waiting for a throttled client would stall every client of the proxy
+	if !clientLimiter.Allow(size) {
+		return true
 	}
+	if !p.opts.limiter(true, exceeded).Wait(size, p.stopCh) {
+		return false
+	}
+
+	p.stats.AddUpload(int64(size))
+	client.flow.AddUpload(int64(size))
+	client.flow.AddUploadPackets(int64(len(msgs)))
+
+	if client.header != nil {
+		msgs[0].Buffers[0] = append(client.header, msgs[0].Buffers[0]...)
+		client.header = nil
+	}
+	if err := writeBatch(client.targetIO, msgs); err != nil {
+		log.Printf("[UDP] %s: write to target error: %v", p.name, err)
+	}
+	return true
+}
+
+// lookupClient returns the session of the client with the given key, or nil.
+func (p *UDPProxy) lookupClient(key string) *udpClient {
+	p.clientsMu.RLock()
+	defer p.clientsMu.RUnlock()
+	return p.clients[key]
 }
 
 func (p *UDPProxy) getOrCreateClient(clientAddr *net.UDPAddr) *udpClient {
@@ -141,6 +254,15 @@ func (p *UDPProxy) getOrCreateClient(clientAddr *net.UDPAddr) *udpClient {
 		return client
 	}
 
+	// A failed dial is logged once clientsMu is released, deferred first
+	// so it runs after the unlock
+	var logDialError func()
+	defer func() {
+		if logDialError != nil {
+			logDialError()
+		}
+	}()
+
 	p.clientsMu.Lock()
 	defer p.clientsMu.Unlock()
 
@@ -149,106 +271,296 @@ func (p *UDPProxy) getOrCreateClient(clientAddr *net.UDPAddr) *udpClient {
 		return client
 	}
 
-	targetConn, err := net.DialUDP("udp", nil, p.targetAddr)
+	select {
+	case <-p.drainCh:
+		return nil // Shutting down, no new sessions
+	default:
+	}
+
+	if p.opts.MaxUDPSessions > 0 && atomic.LoadInt64(&p.stats.ActiveUDPSessions) >= int64(p.opts.MaxUDPSessions) {
+		if p.firstRejection(key) {
+			atomic.AddInt64(&p.stats.Rejected.MaxUDPSessions, 1)
+		}
+		return nil
+	}
+
+	var clientKey string
+	var clientStats *stats.ClientTraffic
+	if p.opts.ClientStats != nil {
+		clientKey = p.opts.ClientStats.Key(clientAddr)
+		clientStats = p.stats.Clients.Get(clientKey)
+		if _, blocked := p.opts.clientLimit(p.name, p.stats, clientKey, clientStats, true); blocked {
+			if p.firstRejection(key) {
+				atomic.AddInt64(&p.stats.Rejected.ClientLimitExceeded, 1)
+				p.opts.Bans.Record(clientAddr.IP.String(), BanRejections)
+			}
+			return nil
+		}
+	}
+
+	ip := clientAddr.IP.String()
+	p.opts.Bans.Record(ip, BanConnections)
+
+	start := time.Now()
+	target := p.targets.Next(ip)
+	targetConn, err := p.opts.Dialer.DialUDP(p.targetAddr[target])
 	if err != nil {
-		log.Printf("[UDP] %s: failed to connect to target: %v", p.name, err)
+		p.opts.Bans.Record(ip, BanDialErrors)
+		logDialError = func() { p.opts.logDialError(p.name, "udp", clientAddr, target.Addr, start) }
+		log.Printf("[UDP] %s: failed to connect to target %s: %v", p.name, target.Addr, err)
 		return nil
 	}
+	target.acquire()
 
 	client = &udpClient{
 		targetConn: targetConn,
+		targetIO:   newBatchConn(targetConn),
 		clientAddr: clientAddr,
-		lastActive: time.Now(),
+		target:     target,
+	}
+	if p.opts.SendProxyProtocol == ProxyProtocolV2 {
+		client.header = proxyHeader(ProxyProtocolV2, clientAddr, p.listener.LocalAddr())
+	}
+	client.flow = p.opts.Conns.Add("udp", key, target.Addr, func() {
+		p.removeClient(key, client)
+	})
+	client.flow.track(target.traffic)
+	client.flow.track(p.stats.Families.Get(addressFamily(clientAddr)))
+	if clientStats != nil {
+		client.flow.trackClient(clientKey, clientStats)
 	}
 	p.clients[key] = client
+	atomic.AddInt64(&p.stats.ActiveUDPSessions, 1)
+	atomic.AddInt64(&p.stats.UDPSessions.Created, 1)
+	client.timer = time.AfterFunc(p.opts.UDPTimeout, func() {
+		p.expireClient(key, client)
+	})
 
 	// Start reading from target for this client
+	p.wg.Add(1)
 	go p.readFromTarget(client, key)
 
 	return client
 }
 
+// firstRejection reports whether a refused session of the client with the
+// given key is counted. A client keeps sending datagrams, each of which is
+// refused again, so its refusal is counted once per UDPTimeout, like one
+// refused TCP connection. It must be called with clientsMu held.
+func (p *UDPProxy) firstRejection(key string) bool {
+	now := time.Now()
+	if until, exists := p.rejected[key]; exists && now.Before(until) {
+		return false
+	}
+	if len(p.rejected) >= maxUDPRejected {
+		for k, until := range p.rejected {
+			if !now.Before(until) {
+				delete(p.rejected, k)
+			}
+		}
+		if len(p.rejected) >= maxUDPRejected {
+			return true
+		}
+	}
+	p.rejected[key] = now.Add(p.opts.UDPTimeout)
+	return true
+}
+
+// readFromTarget relays batches of replies from the target to the client.
+// It blocks in ReadBatch until the session is closed.
 func (p *UDPProxy) readFromTarget(client *udpClient, key string) {
-	buf := make([]byte, udpBufferSize)
+	defer p.wg.Done()
+
+	batch := newUDPBatch(udpSessionBatchSize, p.opts.UDPBufferSize)
 	for {
-		select {
-		case <-p.stopCh:
+		n, err := batch.read(client.targetIO)
+		if err != nil {
+			// Session closed, or the target is unreachable
+			client.flow.setCloseReason(closeReason(err))
+			p.removeClient(key, client)
 			return
-		default:
 		}
 
-		client.targetConn.SetReadDeadline(time.Now().Add(udpTimeout))
-		n, err := client.targetConn.Read(buf)
-		if err != nil {
-			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				p.clientsMu.RLock()
-				lastActive := client.lastActive
-				p.clientsMu.RUnlock()
+		exceeded, blocked := checkLimit(p.name, p.stats)
+		if blocked {
+			continue // Drop the batch when limit exceeded
+		}
+		clientLimiter, blocked := p.opts.clientLimit(p.name, p.stats, client.flow.clientKey, client.flow.client, false)
+		if blocked {
+			continue
+		}
 
-				if time.Since(lastActive) > udpTimeout {
-					p.removeClient(key)
-					return
-				}
-				continue
-			}
-			select {
-			case <-p.stopCh:
-				return
-			default:
-				p.removeClient(key)
-				return
-			}
+		msgs := batch.msgs[:n]
+		var size int
+		for i := range msgs {
+			msgs[i].Addr = client.clientAddr
+			size += msgs[i].N
 		}
 
-		if p.stats.IsLimitExceeded() {
-			continue // Drop packet when limit exceeded
+		if !p.opts.limiter(false, exceeded).Wait(size, p.stopCh) || !clientLimiter.Wait(size, p.stopCh) {
+			return
 		}
 
-		p.stats.AddDownload(int64(n))
-		client.lastActive = time.Now()
+		p.stats.AddDownload(int64(size))
+		client.flow.AddDownload(int64(size))
+		client.flow.AddDownloadPackets(int64(len(msgs)))
 
-		_, err = p.listener.WriteToUDP(buf[:n], client.clientAddr)
-		if err != nil {
+		if err := writeBatch(p.listenIO, msgs); err != nil {
 			log.Printf("[UDP] %s: write to client error: %v", p.name, err)
 		}
 	}
 }
 
-func (p *UDPProxy) removeClient(key string) {
+// removeClient closes client unless it has already been closed.
+func (p *UDPProxy) removeClient(key string, client *udpClient) {
 	p.clientsMu.Lock()
-	defer p.clientsMu.Unlock()
+	removed := p.clients[key] == client
+	if removed {
+		p.closeClient(key, client)
+	}
+	p.clientsMu.Unlock()
 
-	if client, exists := p.clients[key]; exists {
-		client.targetConn.Close()
-		delete(p.clients, key)
+	if removed {
+		p.logClosed(client)
 	}
 }
 
-func (p *UDPProxy) cleanupLoop() {
-	defer p.wg.Done()
+// expireClient runs when client's timer fires. The timer is not reset for
+// every datagram, so a session that was active in the meantime is checked
+// again once it could have been idle for UDPTimeout, but no sooner than
+// UDPCleanupInterval.
+func (p *UDPProxy) expireClient(key string, client *udpClient) {
+	p.clientsMu.Lock()
+	if p.clients[key] != client {
+		p.clientsMu.Unlock()
+		return
+	}
+	if idle := time.Since(client.flow.LastActive()); idle < p.opts.UDPTimeout {
+		client.timer.Reset(max(p.opts.UDPTimeout-idle, p.opts.UDPCleanupInterval))
+		p.clientsMu.Unlock()
+		return
+	}
+	client.flow.setCloseReason(CloseIdleTimeout)
+	p.closeClient(key, client)
+	p.clientsMu.Unlock()
 
-	ticker := time.NewTicker(cleanupInterval)
-	defer ticker.Stop()
+	atomic.AddInt64(&p.stats.UDPSessions.Expired, 1)
+	p.logClosed(client)
+}
 
-	for {
-		select {
-		case <-p.stopCh:
-			return
-		case <-ticker.C:
-			p.cleanupStaleClients()
-		}
+// closeClient must be called with clientsMu held. The caller logs the
+// session with logClosed once it has released clientsMu.
+func (p *UDPProxy) closeClient(key string, client *udpClient) {
+	client.timer.Stop()
+	client.targetConn.Close()
+	client.target.release()
+	delete(p.clients, key)
+	p.opts.Conns.Remove(client.flow)
+	atomic.AddInt64(&p.stats.ActiveUDPSessions, -1)
+}
+
+// logClosed writes the access log entries of closed sessions. Writing, and
+// possibly rotating, the log must not hold up other sessions, so it is
+// called without clientsMu held.
+func (p *UDPProxy) logClosed(clients ...*udpClient) {
+	for _, client := range clients {
+		p.opts.logFlow(p.name, client.flow, client.flow.StartTime)
 	}
 }
 
-func (p *UDPProxy) cleanupStaleClients() {
+// expireClients closes sessions idle for longer than idle and returns the
+// number of sessions left.
+func (p *UDPProxy) expireClients(idle time.Duration) int {
 	p.clientsMu.Lock()
-	defer p.clientsMu.Unlock()
-
 	now := time.Now()
+	var closed []*udpClient
 	for key, client := range p.clients {
-		if now.Sub(client.lastActive) > udpTimeout {
-			client.targetConn.Close()
-			delete(p.clients, key)
+		if now.Sub(client.flow.LastActive()) > idle {
+			client.flow.setCloseReason(CloseShutdown)
+			p.closeClient(key, client)
+			closed = append(closed, client)
+		}
+	}
+	left := len(p.clients)
+	p.clientsMu.Unlock()
+
+	p.logClosed(closed...)
+	return left
+}
+
+func sameUDPAddr(a, b *net.UDPAddr) bool {
+	return a.Port == b.Port && a.IP.Equal(b.IP) && a.Zone == b.Zone
+}
+
+// batchConn reads and writes several datagrams per system call
+// (recvmmsg/sendmmsg on Linux, one datagram per call elsewhere).
+type batchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+func newBatchConn(conn *net.UDPConn) batchConn {
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() != nil {
+		return ipv4.NewPacketConn(conn)
+	}
+	return ipv6.NewPacketConn(conn)
+}
+
+// writeBatch writes all of msgs, using as many system calls as needed.
+func writeBatch(conn batchConn, msgs []ipv4.Message) error {
+	for len(msgs) > 0 {
+		n, err := conn.WriteBatch(msgs, 0)
+		if err != nil {
+			return err
 		}
+		msgs = msgs[n:]
+	}
+	return nil
+}
+
+// udpBatch holds the receive buffers for ReadBatch. It starts with a single
+// buffer of bufferSize bytes and doubles up to max buffers whenever a read
+// fills all of them, so quiet sockets keep the memory footprint of a plain
+// ReadFrom.
+type udpBatch struct {
+	msgs       []ipv4.Message
+	bufs       [][]byte
+	bufferSize int
+	max        int
+	full       bool
+}
+
+func newUDPBatch(max, bufferSize int) *udpBatch {
+	b := &udpBatch{max: max, bufferSize: bufferSize}
+	b.grow(1)
+	return b
+}
+
+func (b *udpBatch) grow(size int) {
+	for len(b.bufs) < size {
+		buf := make([]byte, b.bufferSize)
+		b.bufs = append(b.bufs, buf)
+		b.msgs = append(b.msgs, ipv4.Message{Buffers: [][]byte{buf}})
+	}
+}
+
+// read receives up to len(b.msgs) datagrams from conn. The first n messages
+// then hold the datagrams, each trimmed to its length, and their senders.
+func (b *udpBatch) read(conn batchConn) (int, error) {
+	if b.full {
+		b.grow(min(2*len(b.bufs), b.max))
+	}
+	for i := range b.msgs {
+		b.msgs[i].Buffers[0] = b.bufs[i]
+	}
+
+	n, err := conn.ReadBatch(b.msgs, 0)
+	if err != nil {
+		return 0, err
+	}
+	for i := range b.msgs[:n] {
+		b.msgs[i].Buffers[0] = b.bufs[i][:b.msgs[i].N]
 	}
+	b.full = n == len(b.msgs)
+	return n, nil
 }
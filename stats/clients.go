@@ -0,0 +1,178 @@
+package stats
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ClientTraffic is the traffic of one client address or prefix.
+type ClientTraffic struct {
+	Upload          int64  `json:"upload"`
+	Download        int64  `json:"download"`
+	MonthlyUpload   int64  `json:"monthly_upload"`
+	MonthlyDownload int64  `json:"monthly_download"`
+	CurrentMonth    string `json:"current_month"`
+	LastSeen        int64  `json:"last_seen"` // unix seconds
+
+	exceeded int32 // set once the current over-quota episode has been reported
+}
+
+func (c *ClientTraffic) AddUpload(n int64) {
+	c.checkMonthReset()
+	atomic.AddInt64(&c.Upload, n)
+	atomic.AddInt64(&c.MonthlyUpload, n)
+	atomic.StoreInt64(&c.LastSeen, time.Now().Unix())
+}
+
+func (c *ClientTraffic) AddDownload(n int64) {
+	c.checkMonthReset()
+	atomic.AddInt64(&c.Download, n)
+	atomic.AddInt64(&c.MonthlyDownload, n)
+	atomic.StoreInt64(&c.LastSeen, time.Now().Unix())
+}
+
+func (c *ClientTraffic) checkMonthReset() {
+	current := currentMonth()
+	if c.CurrentMonth != current {
+		atomic.StoreInt64(&c.MonthlyUpload, 0)
+		atomic.StoreInt64(&c.MonthlyDownload, 0)
+		atomic.StoreInt32(&c.exceeded, 0)
+		c.CurrentMonth = current
+	}
+}
+
+// Snapshot returns a copy of c that is safe to read while c is updated.
+func (c *ClientTraffic) Snapshot() ClientTraffic {
+	c.checkMonthReset()
+	return ClientTraffic{
+		Upload:          atomic.LoadInt64(&c.Upload),
+		Download:        atomic.LoadInt64(&c.Download),
+		MonthlyUpload:   atomic.LoadInt64(&c.MonthlyUpload),
+		MonthlyDownload: atomic.LoadInt64(&c.MonthlyDownload),
+		CurrentMonth:    c.CurrentMonth,
+		LastSeen:        atomic.LoadInt64(&c.LastSeen),
+	}
+}
+
+func (c *ClientTraffic) Total() int64 {
+	return atomic.LoadInt64(&c.Upload) + atomic.LoadInt64(&c.Download)
+}
+
+func (c *ClientTraffic) MonthlyTotal() int64 {
+	c.checkMonthReset()
+	return atomic.LoadInt64(&c.MonthlyUpload) + atomic.LoadInt64(&c.MonthlyDownload)
+}
+
+// FirstExceeded returns true exactly once per over-quota episode, so
+// callers can report a crossed client limit without logging on every read.
+func (c *ClientTraffic) FirstExceeded() bool {
+	return atomic.CompareAndSwapInt32(&c.exceeded, 0, 1)
+}
+
+// ClientMap holds per-client counters keyed by client address or prefix,
+// safe for concurrent use. Once it holds more than its maximum number of
+// entries, the tenth of the clients with the least traffic is evicted.
+// Evicted traffic stays in the proxy totals.
+type ClientMap struct {
+	mu      sync.Mutex
+	m       map[string]*ClientTraffic
+	max     int   // 0 = unlimited
+	evicted int64 // entries evicted since start
+}
+
+// SetMax sets the maximum number of entries, 0 = unlimited.
+func (c *ClientMap) SetMax(max int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.max = max
+	c.evict(0)
+}
+
+// Get returns the counters for key, creating them on first use.
+func (c *ClientMap) Get(key string) *ClientTraffic {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.m == nil {
+		c.m = make(map[string]*ClientTraffic)
+	}
+	t, exists := c.m[key]
+	if !exists {
+		c.evict(1)
+		t = &ClientTraffic{CurrentMonth: currentMonth(), LastSeen: time.Now().Unix()}
+		c.m[key] = t
+	}
+	return t
+}
+
+// evict makes room for extra more entries. It must be called with mu held.
+func (c *ClientMap) evict(extra int) {
+	if c.max <= 0 || len(c.m)+extra <= c.max {
+		return
+	}
+
+	keys := make([]string, 0, len(c.m))
+	totals := make(map[string]int64, len(c.m))
+	for key, t := range c.m {
+		keys = append(keys, key)
+		totals[key] = t.Total()
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return totals[keys[i]] < totals[keys[j]]
+	})
+
+	n := len(c.m) + extra - c.max + c.max/10
+	if n > len(keys) {
+		n = len(keys)
+	}
+	for _, key := range keys[:n] {
+		delete(c.m, key)
+	}
+	c.evicted += int64(n)
+}
+
+// Len returns the number of entries.
+func (c *ClientMap) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.m)
+}
+
+// Evicted returns the number of entries evicted to stay within the maximum.
+func (c *ClientMap) Evicted() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.evicted
+}
+
+// Snapshot returns a copy of all counters.
+func (c *ClientMap) Snapshot() map[string]ClientTraffic {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	result := make(map[string]ClientTraffic, len(c.m))
+	for key, t := range c.m {
+		result[key] = t.Snapshot()
+	}
+	return result
+}
+
+func (c *ClientMap) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.Snapshot())
+}
+
+func (c *ClientMap) UnmarshalJSON(data []byte) error {
+	var m map[string]*ClientTraffic
+	if err := json.Unmarshal(data, &m); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.m = m
+	return nil
+}
@@ -1,6 +1,7 @@
 package stats
 
 import (
+	"encoding/json"
 	"fmt"
 	"regexp"
 	"strconv"
@@ -10,6 +11,13 @@ import (
 	"time"
 )
 
+const (
+	PolicyBlock     = "block"      // refuse connections and drop packets
+	PolicyThrottle  = "throttle"   // keep forwarding at the fallback rate
+	PolicyAlertOnly = "alert_only" // only log, keep forwarding at full speed
+	PolicyNone      = "none"       // reported while traffic is within limits
+)
+
 type ProxyStats struct {
 	Name            string `json:"name"`
 	Protocol        string `json:"protocol"`
@@ -22,6 +30,153 @@ type ProxyStats struct {
 	CurrentMonth    string `json:"current_month"`
 	Limit           int64  `json:"limit"`         // 0 = unlimited
 	LimitMonthly    int64  `json:"limit_monthly"` // 0 = unlimited
+	OnExceed        string `json:"on_exceed"`     // block, throttle, or alert_only
+
+	ClientLimit        int64  `json:"client_limit"`         // per client total, 0 = unlimited
+	ClientLimitMonthly int64  `json:"client_limit_monthly"` // per client monthly, 0 = unlimited
+	ClientOnExceed     string `json:"client_on_exceed"`     // block, throttle, or alert_only
+
+	Rejected    Rejections  `json:"rejected"`
+	Errors      Errors      `json:"errors"`
+	UDPSessions UDPSessions `json:"udp_sessions"`
+	Targets     TrafficMap  `json:"targets"`      // per target address
+	Protocols   TrafficMap  `json:"protocols"`    // per sniffed protocol
+	Families    TrafficMap  `json:"families"`     // per client address family, ipv4 or ipv6
+	Clients     ClientMap   `json:"clients"`      // per client address or prefix, if enabled
+	TLSOverhead Traffic     `json:"tls_overhead"` // TLS handshake and record bytes, not part of the totals
+
+	ActiveConnections int64 `json:"-"`
+	ActiveUDPSessions int64 `json:"-"`
+
+	exceeded int32 // set once the current over-limit episode has been reported
+}
+
+// Traffic is a pair of upload and download byte counters.
+type Traffic struct {
+	Upload   int64 `json:"upload"`
+	Download int64 `json:"download"`
+}
+
+func (t *Traffic) AddUpload(n int64) {
+	atomic.AddInt64(&t.Upload, n)
+}
+
+func (t *Traffic) AddDownload(n int64) {
+	atomic.AddInt64(&t.Download, n)
+}
+
+// Snapshot returns a copy of t that is safe to read while t is updated.
+func (t *Traffic) Snapshot() Traffic {
+	return Traffic{
+		Upload:   atomic.LoadInt64(&t.Upload),
+		Download: atomic.LoadInt64(&t.Download),
+	}
+}
+
+// Errors counts failed connections by cause.
+type Errors struct {
+	ClientTLSHandshake int64 `json:"client_tls_handshake"`
+	TargetDial         int64 `json:"target_dial"`
+	TargetTLSHandshake int64 `json:"target_tls_handshake"`
+}
+
+// Snapshot returns a copy of e that is safe to read while e is updated.
+func (e *Errors) Snapshot() Errors {
+	return Errors{
+		ClientTLSHandshake: atomic.LoadInt64(&e.ClientTLSHandshake),
+		TargetDial:         atomic.LoadInt64(&e.TargetDial),
+		TargetTLSHandshake: atomic.LoadInt64(&e.TargetTLSHandshake),
+	}
+}
+
+// UDPSessions counts UDP client sessions over the lifetime of the stats.
+type UDPSessions struct {
+	Created int64 `json:"created"`
+	Expired int64 `json:"expired"` // closed after udp_timeout without traffic
+}
+
+// Snapshot returns a copy of u that is safe to read while u is updated.
+func (u *UDPSessions) Snapshot() UDPSessions {
+	return UDPSessions{
+		Created: atomic.LoadInt64(&u.Created),
+		Expired: atomic.LoadInt64(&u.Expired),
+	}
+}
+
+// TrafficMap is a set of named traffic counters, safe for concurrent use.
+type TrafficMap struct {
+	mu sync.Mutex
+	m  map[string]*Traffic
+}
+
+// Get returns the counters for key, creating them on first use.
+func (t *TrafficMap) Get(key string) *Traffic {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.m == nil {
+		t.m = make(map[string]*Traffic)
+	}
+	c, exists := t.m[key]
+	if !exists {
+		c = &Traffic{}
+		t.m[key] = c
+	}
+	return c
+}
+
+// Snapshot returns a copy of all counters.
+func (t *TrafficMap) Snapshot() map[string]Traffic {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	result := make(map[string]Traffic, len(t.m))
+	for key, c := range t.m {
+		result[key] = c.Snapshot()
+	}
+	return result
+}
+
+func (t *TrafficMap) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.Snapshot())
+}
+
+func (t *TrafficMap) UnmarshalJSON(data []byte) error {
+	var m map[string]*Traffic
+	if err := json.Unmarshal(data, &m); err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.m = m
+	return nil
+}
+
+// Rejections counts connections and sessions refused by the proxy.
+type Rejections struct {
+	LimitExceeded       int64 `json:"limit_exceeded"`
+	MaxConnections      int64 `json:"max_connections"`
+	MaxConnectionsPerIP int64 `json:"max_connections_per_ip"`
+	MaxUDPSessions      int64 `json:"max_udp_sessions"`
+	NoRoute             int64 `json:"no_route"`
+	ClientLimitExceeded int64 `json:"client_limit_exceeded"`
+	Denied              int64 `json:"denied"` // refused by the allow/deny lists
+	Banned              int64 `json:"banned"` // refused because the client IP is banned
+}
+
+// Snapshot returns a copy of r that is safe to read while r is updated.
+func (r *Rejections) Snapshot() Rejections {
+	return Rejections{
+		LimitExceeded:       atomic.LoadInt64(&r.LimitExceeded),
+		MaxConnections:      atomic.LoadInt64(&r.MaxConnections),
+		MaxConnectionsPerIP: atomic.LoadInt64(&r.MaxConnectionsPerIP),
+		MaxUDPSessions:      atomic.LoadInt64(&r.MaxUDPSessions),
+		NoRoute:             atomic.LoadInt64(&r.NoRoute),
+		ClientLimitExceeded: atomic.LoadInt64(&r.ClientLimitExceeded),
+		Denied:              atomic.LoadInt64(&r.Denied),
+		Banned:              atomic.LoadInt64(&r.Banned),
+	}
 }
 
 type StatsManager struct {
@@ -35,7 +190,7 @@ func NewStatsManager() *StatsManager {
 	}
 }
 
-func (m *StatsManager) Register(name, protocol string, listenPort, targetPort int, limit, limitMonthly int64) *ProxyStats {
+func (m *StatsManager) Register(name, protocol string, listenPort, targetPort int, limit, limitMonthly int64, onExceed string) *ProxyStats {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -43,6 +198,7 @@ func (m *StatsManager) Register(name, protocol string, listenPort, targetPort in
 		// Update limits if changed in config
 		s.Limit = limit
 		s.LimitMonthly = limitMonthly
+		s.OnExceed = onExceed
 		return s
 	}
 
@@ -54,6 +210,7 @@ func (m *StatsManager) Register(name, protocol string, listenPort, targetPort in
 		CurrentMonth: currentMonth(),
 		Limit:        limit,
 		LimitMonthly: limitMonthly,
+		OnExceed:     onExceed,
 	}
 	m.stats[name] = s
 	return s
@@ -110,6 +267,7 @@ func (s *ProxyStats) checkMonthReset() {
 	if s.CurrentMonth != current {
 		atomic.StoreInt64(&s.MonthlyUpload, 0)
 		atomic.StoreInt64(&s.MonthlyDownload, 0)
+		atomic.StoreInt32(&s.exceeded, 0)
 		s.CurrentMonth = current
 	}
 }
@@ -133,6 +291,36 @@ func (s *ProxyStats) IsLimitExceeded() bool {
 	return false
 }
 
+// ExceededLimit returns which limit has been reached ("total" or "monthly"),
+// or an empty string if traffic is still within limits.
+func (s *ProxyStats) ExceededLimit() string {
+	if s.IsTotalLimitExceeded() {
+		return "total"
+	}
+	if s.IsMonthlyLimitExceeded() {
+		return "monthly"
+	}
+	return ""
+}
+
+// FirstExceeded returns true exactly once per over-limit episode, so callers
+// can report a crossed limit without logging on every packet.
+func (s *ProxyStats) FirstExceeded() bool {
+	return atomic.CompareAndSwapInt32(&s.exceeded, 0, 1)
+}
+
+// ActivePolicy returns the on_exceed policy currently applied to traffic,
+// or PolicyNone while the proxy is within its limits.
+func (s *ProxyStats) ActivePolicy() string {
+	if !s.IsLimitExceeded() {
+		return PolicyNone
+	}
+	if s.OnExceed == "" {
+		return PolicyBlock
+	}
+	return s.OnExceed
+}
+
 func (s *ProxyStats) IsTotalLimitExceeded() bool {
 	if s.Limit <= 0 {
 		return false
@@ -150,6 +338,25 @@ func (s *ProxyStats) IsMonthlyLimitExceeded() bool {
 	return monthly >= s.LimitMonthly
 }
 
+// SetClientLimits sets the quota every client of the proxy gets on its own.
+func (s *ProxyStats) SetClientLimits(limit, limitMonthly int64, onExceed string) {
+	s.ClientLimit = limit
+	s.ClientLimitMonthly = limitMonthly
+	s.ClientOnExceed = onExceed
+}
+
+// ClientExceededLimit returns which per-client limit c has reached ("total"
+// or "monthly"), or an empty string if c is still within its quota.
+func (s *ProxyStats) ClientExceededLimit(c *ClientTraffic) string {
+	if s.ClientLimit > 0 && c.Total() >= s.ClientLimit {
+		return "total"
+	}
+	if s.ClientLimitMonthly > 0 && c.MonthlyTotal() >= s.ClientLimitMonthly {
+		return "monthly"
+	}
+	return ""
+}
+
 func (s *ProxyStats) GetTotal() int64 {
 	return atomic.LoadInt64(&s.TotalUpload) + atomic.LoadInt64(&s.TotalDownload)
 }
@@ -227,3 +434,61 @@ func ParseBytes(s string) (int64, error) {
 
 	return int64(value), nil
 }
+
+// ParseRate parses a bandwidth such as "10Mbps" (bits per second, decimal
+// units) or "1.5MB/s" (bytes per second, binary units like ParseBytes) and
+// returns it in bytes per second.
+func ParseRate(s string) (int64, error) {
+	if s == "" || s == "0" {
+		return 0, nil
+	}
+
+	s = strings.TrimSpace(strings.ToUpper(s))
+
+	re := regexp.MustCompile(`^(\d+(?:\.\d+)?)\s*(?:([KMGT]?)BPS|([KMGT]?B)/S)$`)
+	matches := re.FindStringSubmatch(s)
+	if matches == nil {
+		return 0, fmt.Errorf("invalid rate format: %s", s)
+	}
+
+	value, err := strconv.ParseFloat(matches[1], 64)
+	if err != nil {
+		return 0, err
+	}
+
+	if matches[3] != "" {
+		perSecond, err := ParseBytes(matches[1] + matches[3])
+		if err != nil {
+			return 0, err
+		}
+		return perSecond, nil
+	}
+
+	switch matches[2] {
+	case "T":
+		value *= 1e12
+	case "G":
+		value *= 1e9
+	case "M":
+		value *= 1e6
+	case "K":
+		value *= 1e3
+	}
+
+	return int64(value / 8), nil
+}
+
+func FormatRate(bytesPerSecond int64) string {
+	bits := float64(bytesPerSecond) * 8
+
+	switch {
+	case bits >= 1e9:
+		return fmt.Sprintf("%.2f Gbps", bits/1e9)
+	case bits >= 1e6:
+		return fmt.Sprintf("%.2f Mbps", bits/1e6)
+	case bits >= 1e3:
+		return fmt.Sprintf("%.2f Kbps", bits/1e3)
+	default:
+		return fmt.Sprintf("%.0f bps", bits)
+	}
+}
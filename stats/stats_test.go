@@ -0,0 +1,42 @@
+package stats
+
+import "testing"
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{in: "", want: 0},
+		{in: "0", want: 0},
+		{in: "800bps", want: 100},
+		{in: "8Kbps", want: 1000},
+		{in: "10Mbps", want: 1250000},
+		{in: "1Gbps", want: 125000000},
+		{in: "1.5Mbps", want: 187500},
+		{in: "10 mbps", want: 1250000},
+		{in: "100B/s", want: 100},
+		{in: "1KB/s", want: 1024},
+		{in: "1.5MB/s", want: 1572864},
+		{in: "2 GB/s", want: 2 << 30},
+		{in: "10", wantErr: true},
+		{in: "10MB", wantErr: true},
+		{in: "10Mb", wantErr: true},
+		{in: "-1Mbps", wantErr: true},
+		{in: "fast", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseRate(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseRate(%q) = %d, want error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ParseRate(%q) = %d, %v, want %d", tt.in, got, err, tt.want)
+		}
+	}
+}